@@ -2,8 +2,17 @@ package config
 
 type Config struct {
 	Agent struct {
-		Name    string `yaml:"name"`
-		Olympus string `yaml:"olympus"`
-		Port    int    `yaml:"port"`
+		Name           string            `yaml:"name"`
+		Olympus        string            `yaml:"olympus"`
+		Port           int               `yaml:"port"`
+		Labels         map[string]string `yaml:"labels"`
+		MaxConcurrency int               `yaml:"max_concurrency"`
+		// Other Olympus instances of the cluster, as host:port.
+		Failover []string `yaml:"failover"`
+		Curve    struct {
+			// Public key of Olympus, CURVE is disabled when empty.
+			ServerKeyFile string `yaml:"server_key_file"`
+			SecretKeyFile string `yaml:"secret_key_file"`
+		} `yaml:"curve"`
 	} `yaml:"agent"`
 }
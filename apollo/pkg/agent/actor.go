@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -8,50 +9,103 @@ import (
 	zmq "github.com/pebbe/zmq4"
 	"google.golang.org/protobuf/proto"
 
+	agentCfg "github.com/project-auxo/auxo/apollo/internal/config"
 	"github.com/project-auxo/auxo/olympus/logging"
+	"github.com/project-auxo/auxo/olympus/pkg/payload"
 	util "github.com/project-auxo/auxo/olympus/pkg/util"
 	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
 )
 
 const (
 	heartbeatInterval = time.Duration(1) * time.Second
+	heartbeatLiveness = 3 // Missed heartbeats before Olympus is presumed dead
+	heartbeatExpiry   = heartbeatInterval * heartbeatLiveness
+	reconnectInit     = time.Duration(1) * time.Second
+	reconnectMax      = time.Duration(32) * time.Second
 	workersEndpoint   = "inproc://workers"
 )
 
-var _readyMsg = &discpb.DiscoveryMessage{
-	Header:  discpb.Header_HEADER_READY,
-	Origin:  &discpb.Entity{Type: agentEntityType},
-	Command: &discpb.DiscoveryMessage_Ready{},
-}
+var (
+	_heartbeatMsg = &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_HEARTBEAT,
+		Origin:  &discpb.Entity{Type: agentEntityType},
+		Command: &discpb.DiscoveryMessage_Heartbeat{Heartbeat: &discpb.Heartbeat{}},
+	}
+	_disconnectMsg = &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_DISCONNECT,
+		Origin:  &discpb.Entity{Type: agentEntityType},
+		Command: &discpb.DiscoveryMessage_Disconnect{Disconnect: &discpb.Disconnect{}},
+	}
+)
 
 type Actor struct {
-	log              logging.Logger
-	name             string
-	externalSocket   *zmq.Socket
-	externalEndpoint string
-	workersSocket    *zmq.Socket // Communicate with internal workers.
-	poller           *zmq.Poller
+	log               logging.Logger
+	name              string
+	externalSocket    *zmq.Socket
+	externalEndpoints []string    // Olympus instances, tried in turn
+	current           int         // Index of the instance in use
+	workersSocket     *zmq.Socket // Communicate with internal workers.
+	poller            *zmq.Poller
+	handlers          map[string]Handler       // Keyed by service name
+	streamHandlers    map[string]StreamHandler // Keyed by service name
+	labels            map[string]string
+	maxConcurrency    int
+	curveServerKey    string // Empty when the connection is plaintext
+	curvePublicKey    string
+	curveSecretKey    string
+
+	lastHeardFromOlympus time.Time             // Olympus is presumed dead after heartbeatExpiry
+	reconnectInterval    time.Duration         // Current reconnect backoff
+	reconnectAt          time.Time             // Zero unless waiting to reconnect
+	heartbeatAt          time.Time             // When to send the next heartbeat
+	inFlight             int                   // Requests handed to workers or streaming
+	streams              map[string]*outStream // Keyed by request id
+	drainDeadline        time.Time             // Set once Olympus asks the actor to drain
+	protocolVersion      uint32                // Negotiated with Olympus
+	features             []string              // Negotiated with Olympus
+	done                 chan struct{}         // Closed when run returns
 }
 
-func newActor(name string, externalEndpoint string) (actor *Actor, err error) {
-	var externalSocketErr error
+func newActor(cfg *agentCfg.Config, externalEndpoints []string) (actor *Actor, err error) {
 	var workersSocketErr error
 
-	actor = &Actor{log: logging.Base(), name: name, externalEndpoint: externalEndpoint, poller: zmq.NewPoller()}
-	actor.externalSocket, externalSocketErr = zmq.NewSocket(zmq.DEALER)
+	actor = &Actor{
+		log:               logging.Base(),
+		name:              cfg.Agent.Name,
+		externalEndpoints: externalEndpoints,
+		handlers:          make(map[string]Handler),
+		streamHandlers:    make(map[string]StreamHandler),
+		streams:           make(map[string]*outStream),
+		labels:            cfg.Agent.Labels,
+		maxConcurrency:    cfg.Agent.MaxConcurrency,
+		reconnectInterval: reconnectInit,
+		done:              make(chan struct{}),
+	}
 	actor.workersSocket, workersSocketErr = zmq.NewSocket(zmq.DEALER)
-	err = multierror.Append(err, externalSocketErr, workersSocketErr)
-	actor.poller.Add(actor.externalSocket, zmq.POLLIN)
-	actor.poller.Add(actor.workersSocket, zmq.POLLIN)
+	if workersSocketErr != nil {
+		err = multierror.Append(err, workersSocketErr)
+	}
+	if curveCfg := cfg.Agent.Curve; curveCfg.ServerKeyFile != "" {
+		if curveErr := actor.loadCurveKeys(
+			curveCfg.ServerKeyFile, curveCfg.SecretKeyFile); curveErr != nil {
+			err = multierror.Append(err, curveErr)
+		}
+	}
+	return
+}
+
+// loadCurveKeys reads the keys the actor connects to Olympus with.
+func (actor *Actor) loadCurveKeys(serverKeyFile, secretKeyFile string) (err error) {
+	if actor.curveServerKey, err = util.ReadCurveKey(serverKeyFile); err != nil {
+		return
+	}
+	actor.curvePublicKey, actor.curveSecretKey, err = util.CurveKeypair(secretKeyFile)
 	return
 }
 
 func (actor *Actor) bind() (err error) {
-	if socketErr := actor.externalSocket.Connect(actor.externalEndpoint); socketErr != nil {
+	if socketErr := actor.connectToBroker(); socketErr != nil {
 		err = multierror.Append(err, socketErr)
-	} else {
-		actor.log.Debugf("%s sending ready message", actor.name)
-		actor.send(actor.externalSocket, _readyMsg)
 	}
 	if socketErr := actor.workersSocket.Bind(workersEndpoint); socketErr != nil {
 		err = multierror.Append(err, socketErr)
@@ -59,6 +113,119 @@ func (actor *Actor) bind() (err error) {
 	return
 }
 
+// connectToBroker (re)creates the socket to Olympus and announces the agent
+// with a READY message. Any previous connection is discarded, which gives the
+// agent a fresh routing identity.
+func (actor *Actor) connectToBroker() (err error) {
+	if actor.externalSocket != nil {
+		actor.externalSocket.SetLinger(0)
+		actor.externalSocket.Close()
+		actor.externalSocket = nil
+	}
+	socket, err := zmq.NewSocket(zmq.DEALER)
+	if err != nil {
+		return
+	}
+	if actor.curveServerKey != "" {
+		err = socket.ClientAuthCurve(
+			actor.curveServerKey, actor.curvePublicKey, actor.curveSecretKey)
+		if err != nil {
+			socket.Close()
+			return
+		}
+	}
+	if err = socket.Connect(actor.externalEndpoints[actor.current]); err != nil {
+		socket.Close()
+		return
+	}
+	actor.externalSocket = socket
+	actor.poller = zmq.NewPoller()
+	actor.poller.Add(actor.externalSocket, zmq.POLLIN)
+	actor.poller.Add(actor.workersSocket, zmq.POLLIN)
+
+	actor.log.Debugf("%s sending ready message", actor.name)
+	// Olympus instances predating version negotiation never send WELCOME, and
+	// speak version 1. Until welcomed, messages are sent without an envelope,
+	// which every version reads.
+	actor.protocolVersion = 1
+	actor.features = util.NegotiateFeatures(actor.protocolVersion, nil)
+	// Olympus dispatches the streams again, from where their clients are.
+	for _, s := range actor.streams {
+		actor.endStream(s)
+	}
+	actor.lastHeardFromOlympus = time.Now()
+	actor.reconnectAt = time.Time{}
+	actor.heartbeatAt = time.Now().Add(heartbeatInterval)
+	err = actor.send(actor.externalSocket, actor.readyMsg())
+	return
+}
+
+// readyMsg announces the services the actor has handlers for.
+func (actor *Actor) readyMsg() *discpb.DiscoveryMessage {
+	ready := &discpb.Ready{
+		Name:            actor.name,
+		ProtocolVersion: util.ProtocolVersion,
+		Labels:          actor.labels,
+		MaxConcurrency:  uint32(actor.maxConcurrency),
+		Features:        util.Features,
+	}
+	for service := range actor.handlers {
+		ready.Services = append(ready.Services, service)
+	}
+	for service := range actor.streamHandlers {
+		if _, found := actor.handlers[service]; !found {
+			ready.Services = append(ready.Services, service)
+		}
+	}
+	return &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_READY,
+		Origin:  &discpb.Entity{Type: agentEntityType},
+		Command: &discpb.DiscoveryMessage_Ready{Ready: ready},
+	}
+}
+
+// reconnect schedules reconnecting to the next Olympus instance once the
+// current backoff interval is over, when run calls reconnectIfDue. The interval
+// doubles once every instance has been tried. Olympus is no longer listened to
+// in the meantime, but the workers still are.
+func (actor *Actor) reconnect() {
+	actor.current = (actor.current + 1) % len(actor.externalEndpoints)
+	actor.log.Warnf("%s reconnecting to Olympus at %s in %v", actor.name,
+		actor.externalEndpoints[actor.current], actor.reconnectInterval)
+	actor.reconnectAt = time.Now().Add(actor.reconnectInterval)
+	if actor.current == 0 && actor.reconnectInterval < reconnectMax {
+		actor.reconnectInterval *= 2
+	}
+	actor.poller.RemoveBySocket(actor.externalSocket)
+}
+
+func (actor *Actor) reconnecting() bool {
+	return !actor.reconnectAt.IsZero()
+}
+
+// reconnectIfDue reconnects once the backoff interval scheduled by reconnect
+// is over. Failing to, it schedules the next attempt.
+func (actor *Actor) reconnectIfDue() {
+	if time.Now().Before(actor.reconnectAt) {
+		return
+	}
+	if err := actor.connectToBroker(); err != nil {
+		actor.log.Errorf("%s failed to reconnect: %v", actor.name, err)
+		actor.reconnect()
+	}
+}
+
+// pollTimeout is how long the actor may wait for a message before it has
+// something to do.
+func (actor *Actor) pollTimeout() time.Duration {
+	if actor.reconnecting() {
+		if left := time.Until(actor.reconnectAt); left < heartbeatInterval {
+			return left
+		}
+	}
+	return heartbeatInterval
+}
+
 func (actor *Actor) close() (err error) {
 	if actor.externalSocket != nil {
 		err = multierror.Append(err, actor.externalSocket.Close())
@@ -72,52 +239,254 @@ func (actor *Actor) close() (err error) {
 }
 
 func (actor *Actor) run() (err error) {
+	defer close(actor.done)
 	err = actor.bind()
 	if err != nil {
 		return
 	}
 	for {
-		polled, err := actor.poller.Poll(heartbeatInterval)
+		polled, err := actor.poller.Poll(actor.pollTimeout())
 		if err != nil {
 			// Interrupted
 			break
 		}
-		if len(polled) > 0 {
-			for _, socket := range polled {
-				switch s := socket.Socket; s {
-				case actor.externalSocket:
-					actor.handleExternalSocket()
-				case actor.workersSocket:
-					actor.handleWorkersSocket()
+		for _, socket := range polled {
+			switch s := socket.Socket; s {
+			case actor.externalSocket:
+				if err := actor.handleExternalSocket(); err != nil {
+					actor.log.Warnf("%s: %v", actor.name, err)
 				}
+			case actor.workersSocket:
+				if err := actor.handleWorkersSocket(); err != nil {
+					actor.log.Warnf("%s: %v", actor.name, err)
+				}
+			}
+		}
+		if actor.draining() && actor.drained() {
+			break
+		}
+		if actor.reconnecting() {
+			actor.reconnectIfDue()
+			continue
+		}
+		// Busy workers don't keep a dead Olympus alive.
+		if time.Since(actor.lastHeardFromOlympus) > heartbeatExpiry {
+			if actor.draining() {
+				actor.log.Warnf("%s lost Olympus while draining", actor.name)
+				break
 			}
+			actor.reconnect()
+			continue
+		}
+
+		if time.Now().After(actor.heartbeatAt) {
+			actor.send(actor.externalSocket, _heartbeatMsg)
+			actor.heartbeatAt = time.Now().Add(heartbeatInterval)
+			actor.expireStreams()
 		}
 	}
 	return
 }
 
+func (actor *Actor) draining() bool {
+	return !actor.drainDeadline.IsZero()
+}
+
+// drained reports whether the actor is done with its work, or out of time,
+// in which case it tells Olympus it is leaving.
+func (actor *Actor) drained() bool {
+	if actor.inFlight > 0 && time.Now().Before(actor.drainDeadline) {
+		return false
+	}
+	if actor.inFlight > 0 {
+		actor.log.Warnf(
+			"%s abandoning %d request(s) at the drain deadline", actor.name, actor.inFlight)
+	}
+	actor.send(actor.externalSocket, _disconnectMsg)
+	return true
+}
+
 func (actor *Actor) handleExternalSocket() (err error) {
-	recvBytes, recvErr := actor.externalSocket.RecvBytes(0)
-	if recvErr != nil {
-		err = multierror.Append(err, recvErr)
+	frames, err := actor.externalSocket.RecvMessageBytes(0)
+	if err != nil {
+		return
+	}
+	body, _, err := util.OpenEnvelope(frames)
+	if err != nil {
+		return
+	}
+	msg, err := util.UnmarshalDiscoveryMessage(body)
+	if err != nil {
+		return
 	}
-	msg, unmarshalErr := util.UnmarshalDiscoveryMessage(recvBytes)
-	if unmarshalErr != nil {
-		err = multierror.Append(err, unmarshalErr)
+	// Olympus is alive.
+	actor.lastHeardFromOlympus = time.Now()
+
+	switch msg.GetHeader() {
+	case discpb.Header_HEADER_HEARTBEAT:
+		actor.reconnectInterval = reconnectInit
+	case discpb.Header_HEADER_REQUEST:
+		actor.reconnectInterval = reconnectInit
+		actor.handleRequest(msg.GetRequest())
+	case discpb.Header_HEADER_WELCOME:
+		actor.handleWelcome(msg.GetWelcome())
+	case discpb.Header_HEADER_CREDIT:
+		actor.handleCredit(msg.GetCredit())
+	case discpb.Header_HEADER_DISCONNECT:
+		if expiration := msg.GetDisconnect().GetExpirationTime(); expiration != nil {
+			// Olympus is going away, finish the current work and leave.
+			actor.drainDeadline = expiration.AsTime()
+			actor.log.Infof("%s draining until %v: %s", actor.name,
+				actor.drainDeadline, msg.GetDisconnect().GetReason())
+			return
+		}
+		if reason := msg.GetDisconnect().GetReason(); reason != "" {
+			// Rejected, back off before trying again.
+			actor.log.Warnf("%s was disconnected by Olympus: %s", actor.name, reason)
+			actor.reconnect()
+			return
+		}
+		actor.log.Infof("%s was asked to reconnect by Olympus", actor.name)
+		if err = actor.connectToBroker(); err != nil {
+			return
+		}
+	default:
+		actor.log.Debugf("%s ignoring %s", actor.name, msg.GetHeader())
 	}
-	fmt.Println(msg)
 	return
 }
 
-func (actor *Actor) handleWorkersSocket() {
-	// Empty
+// handleWelcome adopts the protocol version and features negotiated by
+// Olympus, provided this build speaks them.
+func (actor *Actor) handleWelcome(welcome *discpb.Welcome) {
+	version := welcome.GetProtocolVersion()
+	if version < util.MinProtocolVersion || version > util.ProtocolVersion {
+		actor.log.Errorf("%s can't speak protocol version %d negotiated by Olympus",
+			actor.name, version)
+		actor.reconnect()
+		return
+	}
+	actor.reconnectInterval = reconnectInit
+	actor.protocolVersion = version
+	actor.features = util.NegotiateFeatures(version, welcome.GetFeatures())
+	actor.log.Infof("%s speaking protocol version %d with features %v",
+		actor.name, actor.protocolVersion, actor.features)
+}
+
+// handleRequest runs the handler of the requested service on a worker.
+func (actor *Actor) handleRequest(req *discpb.Request) {
+	if streamHandler, found := actor.streamHandlers[req.GetServiceName()]; found && req.GetStream() {
+		actor.startStream(req, streamHandler)
+		return
+	}
+	handler, found := actor.handlers[req.GetServiceName()]
+	if !found {
+		actor.log.Warnf(
+			"%s has no handler for service %q", actor.name, req.GetServiceName())
+		actor.send(actor.externalSocket, errorReply(req, discpb.Error_SERVICE_ERROR,
+			"no handler for service"))
+		return
+	}
+	socket, err := actor.workerSocket()
+	if err != nil {
+		actor.log.Errorf("%s failed to start a worker: %v", actor.name, err)
+		actor.send(actor.externalSocket, errorReply(req, discpb.Error_SERVICE_ERROR,
+			fmt.Sprintf("agent %s failed to start a worker", actor.name)))
+		return
+	}
+	actor.inFlight++
+	go actor.work(socket, req, handler)
+}
+
+// workerSocket connects a new socket to the workers socket, for a worker to
+// hand its reply back through.
+func (actor *Actor) workerSocket() (socket *zmq.Socket, err error) {
+	if socket, err = zmq.NewSocket(zmq.DEALER); err != nil {
+		return
+	}
+	if err = socket.Connect(workersEndpoint); err != nil {
+		socket.Close()
+		socket = nil
+	}
+	return
+}
+
+// work serves a single request on its own goroutine and hands the reply back
+// to the actor through the worker socket, which it takes over, as ZMQ sockets
+// must not be shared between goroutines.
+func (actor *Actor) work(socket *zmq.Socket, req *discpb.Request, handler Handler) {
+	defer socket.Close()
+
+	// Services registered with the payload package only see the request
+	// types they declared.
+	var reply *discpb.DiscoveryMessage
+	if err := payload.Default.CheckRequest(req.GetServiceName(), req.GetPayload()); err != nil {
+		actor.log.Warnf("%s refusing request %s: %v", actor.name, req.GetId(), err)
+		reply = errorReply(req, discpb.Error_INVALID_REQUEST, err.Error())
+	} else if rep, err := handler(req.GetPayload()); err != nil {
+		actor.log.Warnf(
+			"%s failed to serve %q: %v", actor.name, req.GetServiceName(), err)
+		reply = errorReply(req, discpb.Error_SERVICE_ERROR, err.Error())
+	} else {
+		reply = &discpb.DiscoveryMessage{
+			Header: discpb.Header_HEADER_REPLY,
+			Origin: &discpb.Entity{Type: agentEntityType},
+			Command: &discpb.DiscoveryMessage_Reply{Reply: &discpb.Reply{
+				Payload:     rep,
+				ServiceName: req.GetServiceName(),
+				Client:      req.GetClient(),
+				Id:          req.GetId(),
+			}},
+		}
+	}
+	// The actor frames the reply for Olympus.
+	replyBytes, err := proto.Marshal(reply)
+	if err == nil {
+		_, err = socket.SendBytes(replyBytes, 0)
+	}
+	if err != nil {
+		actor.log.Errorf("%s failed to hand back reply: %v", actor.name, err)
+	}
+}
+
+// errorReply fails the request.
+func errorReply(req *discpb.Request, code discpb.Error_Code, text string) *discpb.DiscoveryMessage {
+	return &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REPLY,
+		Origin: &discpb.Entity{Type: agentEntityType},
+		Command: &discpb.DiscoveryMessage_Reply{Reply: &discpb.Reply{
+			ServiceName: req.GetServiceName(),
+			Client:      req.GetClient(),
+			Id:          req.GetId(),
+			Error:       &discpb.Error{Code: code, Message: text},
+		}},
+	}
+}
+
+// handleWorkersSocket forwards replies from the workers to Olympus, in the
+// envelope of the negotiated version.
+func (actor *Actor) handleWorkersSocket() (err error) {
+	replyBytes, err := actor.workersSocket.RecvBytes(0)
+	if err != nil {
+		return
+	}
+	actor.inFlight--
+	if actor.externalSocket == nil {
+		// Failed to reconnect, Olympus retries the request elsewhere.
+		return errors.New("no connection to Olympus to reply on")
+	}
+	_, err = actor.externalSocket.SendMessageDontwait(
+		util.Envelope(actor.protocolVersion, replyBytes))
+	return
 }
 
+// send frames the message for the negotiated version, so it is only called on
+// the actor.
 func (actor *Actor) send(socket *zmq.Socket, msg *discpb.DiscoveryMessage) (err error) {
 	msgBytes, err := proto.Marshal(msg)
 	if err != nil {
 		return
 	}
-	_, err = socket.SendBytes(msgBytes, zmq.DONTWAIT)
+	_, err = socket.SendMessageDontwait(util.Envelope(actor.protocolVersion, msgBytes))
 	return
 }
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	zmq "github.com/pebbe/zmq4"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	agentCfg "github.com/project-auxo/auxo/apollo/internal/config"
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+const actorTestPort = 25610
+
+// oldBroker stands in for an Olympus instance of version 1, which predates
+// version negotiation.
+type oldBroker struct {
+	t      *testing.T
+	socket *zmq.Socket
+}
+
+func newOldBroker(t *testing.T, port int) *oldBroker {
+	t.Helper()
+	socket, err := zmq.NewSocket(zmq.ROUTER)
+	if err != nil {
+		t.Fatalf("NewSocket: %v", err)
+	}
+	if err = socket.Bind(fmt.Sprintf("tcp://*:%d", port)); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	return &oldBroker{t: t, socket: socket}
+}
+
+// recv returns the sender and the next message, which comes without an
+// envelope as a broker of version 1 predates them.
+func (b *oldBroker) recv() (identity string, msg *discpb.DiscoveryMessage) {
+	b.t.Helper()
+	frames, err := b.socket.RecvMessageBytes(0)
+	if err != nil {
+		b.t.Fatalf("Recv: %v", err)
+	}
+	if len(frames) != 2 {
+		b.t.Fatalf("got %d frame(s) after the identity, want the body alone", len(frames)-1)
+	}
+	if msg, err = util.UnmarshalDiscoveryMessage(frames[1]); err != nil {
+		b.t.Fatalf("Unmarshal: %v", err)
+	}
+	return string(frames[0]), msg
+}
+
+func (b *oldBroker) send(identity string, msg *discpb.DiscoveryMessage) {
+	b.t.Helper()
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		b.t.Fatalf("Marshal: %v", err)
+	}
+	if _, err = b.socket.SendMessage(identity, msgBytes); err != nil {
+		b.t.Fatalf("Send: %v", err)
+	}
+}
+
+func newTestActor(t *testing.T, port int) *Actor {
+	t.Helper()
+	cfg := &agentCfg.Config{}
+	cfg.Agent.Name = "echo-agent"
+	cfg.Agent.MaxConcurrency = 4
+	actor, err := newActor(cfg, []string{fmt.Sprintf("tcp://localhost:%d", port)})
+	if err != nil {
+		t.Fatalf("newActor: %v", err)
+	}
+	actor.handlers["echo"] = func(payload *anypb.Any) (*anypb.Any, error) {
+		return payload, nil
+	}
+	return actor
+}
+
+func TestAgentWithBrokerOfVersion1(t *testing.T) {
+	broker := newOldBroker(t, actorTestPort)
+	defer broker.socket.Close()
+	actor := newTestActor(t, actorTestPort)
+	defer actor.close()
+	if err := actor.bind(); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+
+	identity, msg := broker.recv()
+	if msg.GetHeader() != discpb.Header_HEADER_READY {
+		t.Fatalf("got %s, want READY", msg.GetHeader())
+	}
+	if v := msg.GetReady().GetProtocolVersion(); v != util.ProtocolVersion {
+		t.Errorf("READY of version %d, want %d", v, util.ProtocolVersion)
+	}
+
+	// Never welcomed, the agent keeps to version 1 and serves requests.
+	payload, _ := anypb.New(wrapperspb.String("hello"))
+	broker.send(identity, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REQUEST,
+		Origin: &discpb.Entity{Type: discpb.Entity_BROKER},
+		Command: &discpb.DiscoveryMessage_Request{Request: &discpb.Request{
+			ServiceName: "echo",
+			Id:          "1",
+			Payload:     payload,
+		}},
+	})
+	if err := actor.handleExternalSocket(); err != nil {
+		t.Fatalf("handleExternalSocket: %v", err)
+	}
+	if actor.protocolVersion != 1 {
+		t.Errorf("speaking version %d, want 1", actor.protocolVersion)
+	}
+	if want := []string{util.FeatureConcurrency}; !reflect.DeepEqual(actor.features, want) {
+		t.Errorf("features %v, want %v", actor.features, want)
+	}
+	if err := actor.handleWorkersSocket(); err != nil {
+		t.Fatalf("handleWorkersSocket: %v", err)
+	}
+	if _, msg = broker.recv(); msg.GetReply().GetId() != "1" {
+		t.Fatalf("got %v, want the reply to request 1", msg)
+	}
+	if !proto.Equal(msg.GetReply().GetPayload(), payload) {
+		t.Errorf("replied %v, want %v", msg.GetReply().GetPayload(), payload)
+	}
+}
+
+func TestRequestForUnknownServiceFails(t *testing.T) {
+	broker := newOldBroker(t, actorTestPort+1)
+	defer broker.socket.Close()
+	actor := newTestActor(t, actorTestPort+1)
+	defer actor.close()
+	if err := actor.bind(); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	identity, _ := broker.recv()
+
+	broker.send(identity, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REQUEST,
+		Origin: &discpb.Entity{Type: discpb.Entity_BROKER},
+		Command: &discpb.DiscoveryMessage_Request{Request: &discpb.Request{
+			ServiceName: "teleport",
+			Id:          "1",
+		}},
+	})
+	if err := actor.handleExternalSocket(); err != nil {
+		t.Fatalf("handleExternalSocket: %v", err)
+	}
+	_, msg := broker.recv()
+	if reply := msg.GetReply(); reply.GetId() != "1" ||
+		reply.GetError().GetCode() != discpb.Error_SERVICE_ERROR {
+		t.Fatalf("got %v, want request 1 to fail", msg)
+	}
+	if actor.inFlight != 0 {
+		t.Errorf("%d request(s) in flight, want 0", actor.inFlight)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	zmq "github.com/pebbe/zmq4"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 
 	agentCfg "github.com/project-auxo/auxo/apollo/internal/config"
 	"github.com/project-auxo/auxo/olympus/logging"
@@ -25,6 +26,9 @@ type ZeroMqSender interface {
 	send(socket *zmq.Socket, msg *discpb.DiscoveryMessage) (err error)
 }
 
+// Handler serves a request for one of the services offered by the agent.
+type Handler func(payload *anypb.Any) (*anypb.Any, error)
+
 type Agent struct {
 	log     logging.Logger
 	name    string
@@ -35,10 +39,29 @@ type Agent struct {
 func New(cfg *agentCfg.Config) (agent *Agent) {
 	olympus := fmt.Sprintf("tcp://%s:%d", cfg.Agent.Olympus, cfg.Agent.Port)
 	agent = &Agent{log: logging.Base(), name: cfg.Agent.Name, olympus: olympus}
-	agent.actor, _ = newActor(agent.name, olympus)
+	endpoints := []string{olympus}
+	for _, failover := range cfg.Agent.Failover {
+		endpoints = append(endpoints, "tcp://"+failover)
+	}
+	var err error
+	if agent.actor, err = newActor(cfg, endpoints); err != nil {
+		agent.log.Fatalf("Failed to set up agent %s: %v", agent.name, err)
+	}
 	return
 }
 
+// Handle registers the handler for the named service. The agent offers the
+// services it has handlers for, so Handle must be called before Run.
+func (agent *Agent) Handle(service string, handler Handler) {
+	agent.actor.handlers[service] = handler
+}
+
+// HandleStream registers the handler for the named service's requests for a
+// streamed reply. Like Handle, it must be called before Run.
+func (agent *Agent) HandleStream(service string, handler StreamHandler) {
+	agent.actor.streamHandlers[service] = handler
+}
+
 func (agent *Agent) close() {
 	agent.actor.close()
 }
@@ -53,9 +76,13 @@ func (agent *Agent) Run() (err error) {
 	// TODO(bellabah): Testing, not to be shipped to production
 	go agent.playSeekGame()
 
-	interrupt := <-runChan
-	agent.log.Infof(
-		"Auxo agent %s is shutting down due to %+v\n", agent.name, interrupt)
+	select {
+	case interrupt := <-runChan:
+		agent.log.Infof(
+			"Auxo agent %s is shutting down due to %+v\n", agent.name, interrupt)
+	case <-agent.actor.done:
+		agent.log.Infof("Auxo agent %s has drained and is shutting down", agent.name)
+	}
 	return
 }
 
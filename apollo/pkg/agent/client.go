@@ -2,13 +2,253 @@ package agent
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
 
 	zmq "github.com/pebbe/zmq4"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+const (
+	clientEntityType = discpb.Entity_CLIENT
+	clientTimeout    = time.Duration(2500) * time.Millisecond
+	maxResumes       = 3 // Reconnections in a row while fetching a stream
 )
 
 var errPermanent = errors.New("permanent error, abandoning request")
 
+// Client calls services offered by agents through Olympus. Requests are
+// asynchronous: any number of them may be sent before receiving the replies,
+// which are matched to the requests by their correlation ID.
 type Client struct {
-	socket  *zmq.Socket
-	olympus string // Where to connect to Olympus
+	socket            *zmq.Socket
+	poller            *zmq.Poller
+	olympus           string        // Where to connect to Olympus
+	timeout           time.Duration // How long Recv waits for a reply
+	auth              func(*zmq.Socket) error
+	nextCorrelationID uint64
+}
+
+func NewClient(olympus string) (client *Client, err error) {
+	return newClient(olympus, nil)
+}
+
+// NewCurveClient connects to an Olympus using CURVE, whose public key is
+// serverKey. Olympus must allow the client's public key.
+func NewCurveClient(olympus, serverKey, publicKey, secretKey string) (*Client, error) {
+	return newClient(olympus, func(socket *zmq.Socket) error {
+		return socket.ClientAuthCurve(serverKey, publicKey, secretKey)
+	})
+}
+
+// newClient connects to Olympus, after setting up the socket's security
+// mechanism with auth if given.
+func newClient(olympus string, auth func(*zmq.Socket) error) (client *Client, err error) {
+	client = &Client{olympus: olympus, timeout: clientTimeout, auth: auth}
+	if err = client.connect(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// connect opens a new socket to Olympus, closing the previous one if any.
+func (client *Client) connect() (err error) {
+	if client.socket != nil {
+		client.socket.SetLinger(0)
+		client.socket.Close()
+		client.socket = nil
+	}
+	socket, err := zmq.NewSocket(zmq.DEALER)
+	if err != nil {
+		return
+	}
+	if client.auth != nil {
+		if err = client.auth(socket); err != nil {
+			socket.Close()
+			return
+		}
+	}
+	if err = socket.Connect(client.olympus); err != nil {
+		socket.Close()
+		return
+	}
+	client.socket = socket
+	client.poller = zmq.NewPoller()
+	client.poller.Add(client.socket, zmq.POLLIN)
+	return
+}
+
+// SetTimeout sets how long Recv waits for a reply.
+func (client *Client) SetTimeout(timeout time.Duration) {
+	client.timeout = timeout
+}
+
+func (client *Client) Close() (err error) {
+	if client.socket != nil {
+		err = client.socket.Close()
+		client.socket = nil
+	}
+	return
+}
+
+// Send asks Olympus to route the payload to an agent offering the service.
+func (client *Client) Send(service string, payload *anypb.Any) (err error) {
+	return client.SendRequest(&discpb.Request{Payload: payload, ServiceName: service})
+}
+
+// SendRequest asks Olympus to route the request, which may carry routing
+// options such as a label selector. Requests without a correlation ID are
+// given one, which the reply carries too.
+func (client *Client) SendRequest(req *discpb.Request) (err error) {
+	if req.CorrelationId == "" {
+		client.nextCorrelationID++
+		req.CorrelationId = strconv.FormatUint(client.nextCorrelationID, 10)
+	}
+	msg := &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_REQUEST,
+		Origin:  &discpb.Entity{Type: clientEntityType},
+		Command: &discpb.DiscoveryMessage_Request{Request: req},
+	}
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		return
+	}
+	_, err = client.socket.SendMessage(util.Envelope(util.ProtocolVersion, msgBytes))
+	return
+}
+
+// Recv waits for the next reply, returning errPermanent if none arrives in
+// time. A reply carrying an error, from Olympus or the agent, is returned
+// along with the error.
+func (client *Client) Recv() (reply *discpb.Reply, err error) {
+	for {
+		polled, err := client.poller.Poll(client.timeout)
+		if err != nil {
+			return nil, err
+		}
+		if len(polled) == 0 {
+			return nil, errPermanent
+		}
+		frames, err := client.socket.RecvMessageBytes(0)
+		if err != nil {
+			return nil, err
+		}
+		body, _, err := util.OpenEnvelope(frames)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := util.UnmarshalDiscoveryMessage(body)
+		if err != nil {
+			return nil, err
+		}
+		if msg.GetHeader() != discpb.Header_HEADER_REPLY {
+			continue
+		}
+		reply = msg.GetReply()
+		if replyErr := reply.GetError(); replyErr != nil {
+			return reply, fmt.Errorf("%s: %s", replyErr.GetCode(), replyErr.GetMessage())
+		}
+		return reply, nil
+	}
+}
+
+// Fetch sends the request for a streamed reply and writes the chunks of the
+// reply to w in order, granting Olympus credit for more as it goes. If
+// Olympus goes silent in the middle of the stream, the client reconnects and
+// resumes it where it left off, up to maxResumes times in a row.
+func (client *Client) Fetch(req *discpb.Request, w io.Writer) (err error) {
+	req.Stream = true
+	if err = client.SendRequest(req); err != nil {
+		return
+	}
+	var id, token string // Identifier and resume token, known from the first chunk
+	var next uint64      // Sequence number of the next chunk expected
+	resumes := 0
+	for {
+		polled, err := client.poller.Poll(client.timeout)
+		if err != nil {
+			return err
+		}
+		if len(polled) == 0 {
+			if id == "" || resumes == maxResumes {
+				return errPermanent
+			}
+			resumes++
+			if err = client.connect(); err != nil {
+				return err
+			}
+			if err = client.sendCredit(id, token, next); err != nil {
+				return err
+			}
+			continue
+		}
+		frames, err := client.socket.RecvMessageBytes(0)
+		if err != nil {
+			return err
+		}
+		body, _, err := util.OpenEnvelope(frames)
+		if err != nil {
+			return err
+		}
+		msg, err := util.UnmarshalDiscoveryMessage(body)
+		if err != nil {
+			return err
+		}
+		switch msg.GetHeader() {
+		case discpb.Header_HEADER_REPLY:
+			reply := msg.GetReply()
+			if reply.GetCorrelationId() != req.GetCorrelationId() {
+				continue
+			}
+			if replyErr := reply.GetError(); replyErr != nil {
+				return fmt.Errorf("%s: %s", replyErr.GetCode(), replyErr.GetMessage())
+			}
+			return errors.New("the agent did not stream the reply")
+		case discpb.Header_HEADER_CHUNK:
+			chunk := msg.GetChunk()
+			if chunk.GetCorrelationId() != req.GetCorrelationId() || chunk.GetSequence() != next {
+				continue
+			}
+			resumes = 0
+			id, token = chunk.GetId(), chunk.GetResumeToken()
+			if _, err = w.Write(chunk.GetData()); err != nil {
+				return err
+			}
+			next++
+			if err = client.sendCredit(id, token, next); err != nil {
+				return err
+			}
+			if chunk.GetLast() {
+				return nil
+			}
+		}
+	}
+}
+
+// sendCredit acknowledges the chunks of the stream before next, and lets
+// Olympus send more. The resume token lets a new connection take over the
+// stream.
+func (client *Client) sendCredit(id, token string, next uint64) (err error) {
+	msg := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_CREDIT,
+		Origin: &discpb.Entity{Type: clientEntityType},
+		Command: &discpb.DiscoveryMessage_Credit{Credit: &discpb.Credit{
+			Id:           id,
+			NextSequence: next,
+			Credit:       util.ChunkCredit,
+			ResumeToken:  token,
+		}},
+	}
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		return
+	}
+	_, err = client.socket.SendMessage(util.Envelope(util.ProtocolVersion, msgBytes))
+	return
 }
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"io"
+	"time"
+
+	"google.golang.org/protobuf/types/known/anypb"
+
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+// StreamHandler serves a request whose reply is too large for a single
+// message, such as a sim recording or a model checkpoint. It returns the
+// source of the reply, which the agent reads in chunks as the client takes
+// them, and closes once done with if it is an io.Closer. It runs on the actor,
+// so it must return quickly.
+type StreamHandler func(payload *anypb.Any) (src io.ReaderAt, size int64, err error)
+
+// Streams Olympus sends no credit for in this long are abandoned, as the
+// client or Olympus gave up on them. Olympus gives up on a stream after its
+// reply timeout, 30 seconds by default.
+const streamExpiry = time.Duration(60) * time.Second
+
+// outStream is a reply the actor streams to Olympus.
+type outStream struct {
+	id       string
+	req      *discpb.Request
+	src      io.ReaderAt
+	size     int64
+	chunks   uint64    // Number of chunks in the reply
+	next     uint64    // Sequence number of the next chunk to send
+	allowed  uint64    // Sequence number of the first chunk past the credit
+	activeAt time.Time // When Olympus last asked for chunks
+}
+
+// startStream opens the reply to a streamed request and sends the first
+// chunks, from where Olympus asks to resume.
+func (actor *Actor) startStream(req *discpb.Request, handler StreamHandler) {
+	src, size, err := handler(req.GetPayload())
+	if err != nil {
+		actor.log.Warnf(
+			"%s failed to serve %q: %v", actor.name, req.GetServiceName(), err)
+		actor.send(actor.externalSocket,
+			errorReply(req, discpb.Error_SERVICE_ERROR, err.Error()))
+		return
+	}
+	if previous, found := actor.streams[req.GetId()]; found {
+		// Olympus resumes the stream afresh.
+		closeSource(previous)
+	} else {
+		actor.inFlight++
+	}
+	s := &outStream{
+		id:       req.GetId(),
+		req:      req,
+		src:      src,
+		size:     size,
+		chunks:   util.ChunkCount(size),
+		next:     req.GetResumeFrom(),
+		allowed:  req.GetResumeFrom() + util.ChunkCredit,
+		activeAt: time.Now(),
+	}
+	actor.streams[s.id] = s
+	actor.pump(s)
+}
+
+// handleCredit lets a stream send more chunks, or ends it once the client
+// received all of them.
+func (actor *Actor) handleCredit(credit *discpb.Credit) {
+	s, found := actor.streams[credit.GetId()]
+	if !found {
+		return
+	}
+	if credit.GetNextSequence() >= s.chunks {
+		actor.endStream(s)
+		return
+	}
+	if credit.GetResume() {
+		// The client may have missed chunks, send them again.
+		s.next = credit.GetNextSequence()
+	}
+	s.allowed = credit.GetNextSequence() + uint64(credit.GetCredit())
+	s.activeAt = time.Now()
+	actor.pump(s)
+}
+
+// expireStreams abandons the streams that went without credit for too long,
+// which frees their slots.
+func (actor *Actor) expireStreams() {
+	for id, s := range actor.streams {
+		if time.Since(s.activeAt) > streamExpiry {
+			actor.log.Warnf("%s abandoning stream %s after %v without credit",
+				actor.name, id, streamExpiry)
+			actor.endStream(s)
+		}
+	}
+}
+
+// endStream is done with the stream, which frees its slot.
+func (actor *Actor) endStream(s *outStream) {
+	delete(actor.streams, s.id)
+	actor.inFlight--
+	closeSource(s)
+}
+
+func closeSource(s *outStream) {
+	if closer, ok := s.src.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// pump sends the chunks of the stream that the credit allows.
+func (actor *Actor) pump(s *outStream) {
+	for ; s.next < s.allowed && s.next < s.chunks; s.next++ {
+		offset := int64(s.next) * util.ChunkSize
+		length := s.size - offset
+		if length > util.ChunkSize {
+			length = util.ChunkSize
+		}
+		data := make([]byte, length)
+		if _, err := s.src.ReadAt(data, offset); err != nil && err != io.EOF {
+			actor.log.Errorf("%s failed to read chunk %d of %s: %v", actor.name, s.next, s.id, err)
+			actor.send(actor.externalSocket,
+				errorReply(s.req, discpb.Error_SERVICE_ERROR, err.Error()))
+			actor.endStream(s)
+			return
+		}
+		err := actor.send(actor.externalSocket, &discpb.DiscoveryMessage{
+			Header: discpb.Header_HEADER_CHUNK,
+			Origin: &discpb.Entity{Type: agentEntityType},
+			Command: &discpb.DiscoveryMessage_Chunk{Chunk: &discpb.Chunk{
+				Id:       s.id,
+				Sequence: s.next,
+				Data:     data,
+				Last:     s.next == s.chunks-1,
+				Size:     uint64(s.size),
+			}},
+		})
+		if err != nil {
+			// Olympus asks for the chunk again once it gets through.
+			actor.log.Warnf("%s failed to send chunk %d of %s: %v", actor.name, s.next, s.id, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/anypb"
+
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+func TestIdleStreamsExpire(t *testing.T) {
+	actor := newTestActor(t, actorTestPort)
+	defer actor.close()
+	actor.streams["1"] = &outStream{id: "1", activeAt: time.Now().Add(-2 * streamExpiry)}
+	actor.streams["2"] = &outStream{id: "2", activeAt: time.Now()}
+	actor.inFlight = 2
+	actor.expireStreams()
+	if _, found := actor.streams["1"]; found {
+		t.Error("stream 1 is kept after going without credit")
+	}
+	if _, found := actor.streams["2"]; !found {
+		t.Error("stream 2 expired while active")
+	}
+	if actor.inFlight != 1 {
+		t.Errorf("%d request(s) in flight, want 1", actor.inFlight)
+	}
+}
+
+// brokenSource fails every read.
+type brokenSource struct{ closed bool }
+
+func (s *brokenSource) ReadAt([]byte, int64) (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+func (s *brokenSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestStreamFailsOnReadError(t *testing.T) {
+	broker := newOldBroker(t, actorTestPort+2)
+	defer broker.socket.Close()
+	actor := newTestActor(t, actorTestPort+2)
+	defer actor.close()
+	if err := actor.bind(); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	broker.recv()
+
+	src := &brokenSource{}
+	actor.startStream(&discpb.Request{ServiceName: "echo", Id: "1", Stream: true},
+		func(*anypb.Any) (io.ReaderAt, int64, error) { return src, 10, nil })
+	_, msg := broker.recv()
+	if reply := msg.GetReply(); reply.GetId() != "1" ||
+		reply.GetError().GetCode() != discpb.Error_SERVICE_ERROR {
+		t.Fatalf("got %v, want request 1 to fail", msg)
+	}
+	if _, found := actor.streams["1"]; found || actor.inFlight != 0 {
+		t.Errorf("stream kept with %d request(s) in flight", actor.inFlight)
+	}
+	if !src.closed {
+		t.Error("the source of the failed stream was left open")
+	}
+}
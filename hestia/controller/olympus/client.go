@@ -8,6 +8,7 @@ import (
 
 	hestiaCfg "github.com/project-auxo/auxo/hestia/internal/config"
 	"github.com/project-auxo/auxo/olympus/logging"
+	"github.com/project-auxo/auxo/olympus/pkg/util"
 	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
 )
 
@@ -19,9 +20,13 @@ var (
 
 func GetClient(cfg *hestiaCfg.Config) pb.OlympusFrontendServiceClient {
 	once.Do(func() {
+		creds, err := util.DialOption(cfg.Hestia.FrontendClient.TLS)
+		if err != nil {
+			log.Fatalf("tls: %v", err)
+		}
 		conn, err := grpc.Dial(
 			fmt.Sprintf("%s:%d", cfg.Hestia.FrontendClient.Hostname,
-				cfg.Hestia.FrontendClient.Port), grpc.WithInsecure())
+				cfg.Hestia.FrontendClient.Port), creds)
 		if err != nil {
 			log.Fatalf("dial: %v", err)
 		}
@@ -2,10 +2,16 @@ package olympus
 
 import (
 	"context"
+	"io"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	"github.com/project-auxo/auxo/olympus/logging"
 	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
@@ -22,7 +28,206 @@ func GetNumberOfAgents(client pb.OlympusFrontendServiceClient) gin.HandlerFunc {
 		if err != nil {
 			gctx.String(
 				http.StatusInternalServerError, "%v.GetNumberOfAgents(_) = _, %v", client, err)
+			return
 		}
 		gctx.JSON(http.StatusOK, getNumberOfAgentsRep.Number)
 	}
 }
+
+// List the agents that are operating on Olympus, a page at a time
+func ListAgents(client pb.OlympusFrontendServiceClient) gin.HandlerFunc {
+	return func(gctx *gin.Context) {
+		req := &pb.ListAgentsReq{PageToken: gctx.Query("page_token")}
+		if pageSize := gctx.Query("page_size"); pageSize != "" {
+			n, err := strconv.Atoi(pageSize)
+			if err != nil {
+				gctx.String(http.StatusBadRequest, "invalid page_size %q", pageSize)
+				return
+			}
+			req.PageSize = int32(n)
+		}
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Duration(10)*time.Second)
+		defer cancel()
+		listAgentsRep, err := client.ListAgents(ctx, req)
+		if err != nil {
+			gctx.String(
+				http.StatusInternalServerError, "%v.ListAgents(_) = _, %v", client, err)
+			return
+		}
+		gctx.JSON(http.StatusOK, listAgentsRep)
+	}
+}
+
+// Get a single agent that is operating on Olympus
+func GetAgent(client pb.OlympusFrontendServiceClient) gin.HandlerFunc {
+	return func(gctx *gin.Context) {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Duration(10)*time.Second)
+		defer cancel()
+		getAgentRep, err := client.GetAgent(
+			ctx, &pb.GetAgentReq{Identity: gctx.Param("identity")})
+		if status.Code(err) == codes.NotFound {
+			gctx.String(http.StatusNotFound, "%v", err)
+			return
+		}
+		if err != nil {
+			gctx.String(
+				http.StatusInternalServerError, "%v.GetAgent(_) = _, %v", client, err)
+			return
+		}
+		gctx.JSON(http.StatusOK, getAgentRep.Agent)
+	}
+}
+
+// Get the request counters of Olympus, for monitoring
+func GetStats(client pb.OlympusFrontendServiceClient) gin.HandlerFunc {
+	return func(gctx *gin.Context) {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Duration(10)*time.Second)
+		defer cancel()
+		getStatsRep, err := client.GetStats(ctx, &pb.GetStatsReq{})
+		if err != nil {
+			gctx.String(
+				http.StatusInternalServerError, "%v.GetStats(_) = _, %v", client, err)
+			return
+		}
+		gctx.JSON(http.StatusOK, getStatsRep)
+	}
+}
+
+// Stream agent lifecycle events from Olympus as server-sent events
+func WatchAgents(client pb.OlympusFrontendServiceClient) gin.HandlerFunc {
+	return func(gctx *gin.Context) {
+		stream, err := client.WatchAgents(gctx.Request.Context(), &pb.WatchAgentsReq{
+			Service: gctx.Query("service"),
+			Name:    gctx.Query("name"),
+		})
+		if err != nil {
+			gctx.String(
+				http.StatusInternalServerError, "%v.WatchAgents(_) = _, %v", client, err)
+			return
+		}
+		gctx.Stream(func(w io.Writer) bool {
+			event, err := stream.Recv()
+			if err != nil {
+				return false
+			}
+			gctx.SSEvent("agent", event)
+			return true
+		})
+	}
+}
+
+// adminReq is the body of the requests acting on an agent.
+type adminReq struct {
+	Reason string `json:"reason" binding:"required"`
+	// Resume routing to a quarantined agent.
+	Release bool `json:"release"`
+	// How long a drained agent has to finish its work, e.g. "30s".
+	Timeout string `json:"timeout"`
+}
+
+// operator names the signed in user, for the audit log of Olympus.
+func operator(gctx *gin.Context) string {
+	profile, _ := sessions.Default(gctx).Get("profile").(map[string]interface{})
+	if name, ok := profile["name"].(string); ok {
+		return name
+	}
+	return ""
+}
+
+// adminError reports the failure of a request acting on an agent.
+func adminError(gctx *gin.Context, client pb.OlympusFrontendServiceClient, rpc string, err error) {
+	switch status.Code(err) {
+	case codes.NotFound:
+		gctx.String(http.StatusNotFound, "%v", err)
+	case codes.InvalidArgument:
+		gctx.String(http.StatusBadRequest, "%v", err)
+	default:
+		gctx.String(
+			http.StatusInternalServerError, "%v.%s(_) = _, %v", client, rpc, err)
+	}
+}
+
+// Disconnect an agent from Olympus
+func DisconnectAgent(client pb.OlympusFrontendServiceClient) gin.HandlerFunc {
+	return func(gctx *gin.Context) {
+		var body adminReq
+		if err := gctx.ShouldBindJSON(&body); err != nil {
+			gctx.String(http.StatusBadRequest, "%v", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Duration(10)*time.Second)
+		defer cancel()
+		_, err := client.DisconnectAgent(ctx, &pb.DisconnectAgentReq{
+			Identity: gctx.Param("identity"),
+			Reason:   body.Reason,
+			Operator: operator(gctx),
+		})
+		if err != nil {
+			adminError(gctx, client, "DisconnectAgent", err)
+			return
+		}
+		gctx.Status(http.StatusNoContent)
+	}
+}
+
+// Stop, or with release resume, routing requests to an agent
+func QuarantineAgent(client pb.OlympusFrontendServiceClient) gin.HandlerFunc {
+	return func(gctx *gin.Context) {
+		var body adminReq
+		if err := gctx.ShouldBindJSON(&body); err != nil {
+			gctx.String(http.StatusBadRequest, "%v", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Duration(10)*time.Second)
+		defer cancel()
+		quarantineAgentRep, err := client.QuarantineAgent(ctx, &pb.QuarantineAgentReq{
+			Identity: gctx.Param("identity"),
+			Reason:   body.Reason,
+			Operator: operator(gctx),
+			Release:  body.Release,
+		})
+		if err != nil {
+			adminError(gctx, client, "QuarantineAgent", err)
+			return
+		}
+		gctx.JSON(http.StatusOK, quarantineAgentRep.Agent)
+	}
+}
+
+// Let an agent finish its in-flight requests, then disconnect it
+func DrainAgent(client pb.OlympusFrontendServiceClient) gin.HandlerFunc {
+	return func(gctx *gin.Context) {
+		var body adminReq
+		if err := gctx.ShouldBindJSON(&body); err != nil {
+			gctx.String(http.StatusBadRequest, "%v", err)
+			return
+		}
+		req := &pb.DrainAgentReq{
+			Identity: gctx.Param("identity"),
+			Reason:   body.Reason,
+			Operator: operator(gctx),
+		}
+		if body.Timeout != "" {
+			timeout, err := time.ParseDuration(body.Timeout)
+			if err != nil {
+				gctx.String(http.StatusBadRequest, "invalid timeout %q", body.Timeout)
+				return
+			}
+			req.Timeout = durationpb.New(timeout)
+		}
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Duration(10)*time.Second)
+		defer cancel()
+		drainAgentRep, err := client.DrainAgent(ctx, req)
+		if err != nil {
+			adminError(gctx, client, "DrainAgent", err)
+			return
+		}
+		gctx.JSON(http.StatusOK, drainAgentRep.Agent)
+	}
+}
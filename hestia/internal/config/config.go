@@ -1,12 +1,15 @@
 package config
 
+import "github.com/project-auxo/auxo/olympus/pkg/util"
+
 type Config struct {
 	Hestia struct {
 		Hostname       string `yaml:"hostname"`
 		Port           int    `yaml:"port"`
 		FrontendClient struct {
-			Hostname string `yaml:"hostname"`
-			Port     int    `yaml:"port"`
+			Hostname string         `yaml:"hostname"`
+			Port     int            `yaml:"port"`
+			TLS      util.TLSConfig `yaml:"tls"`
 		} `yaml:"frontend_client"`
 	} `yaml:"hestia"`
 }
@@ -59,5 +59,15 @@ func addOlympus(rg *gin.RouterGroup, cfg *hestiaCfg.Config) {
 	olympus := rg.Group("/olympus")
 	{
 		olympus.GET("/agents/num", olympusCtrl.GetNumberOfAgents(client))
+		olympus.GET("/agents", olympusCtrl.ListAgents(client))
+		olympus.GET("/agents/watch", olympusCtrl.WatchAgents(client))
+		olympus.GET("/agents/:identity", olympusCtrl.GetAgent(client))
+		olympus.GET("/stats", olympusCtrl.GetStats(client))
+
+		// Operator actions, recorded in the audit log of Olympus.
+		admin := olympus.Group("/agents/:identity", middleware.IsAuthenticated)
+		admin.POST("/disconnect", olympusCtrl.DisconnectAgent(client))
+		admin.POST("/quarantine", olympusCtrl.QuarantineAgent(client))
+		admin.POST("/drain", olympusCtrl.DrainAgent(client))
 	}
 }
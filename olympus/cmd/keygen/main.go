@@ -0,0 +1,33 @@
+// Command keygen generates the CURVE keypairs securing the connections to
+// Olympus. The public key of an agent or client goes into the allow-list of
+// the broker, and the public key of the broker into the agent or client
+// configuration.
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	zmq "github.com/pebbe/zmq4"
+
+	"github.com/project-auxo/auxo/olympus/logging"
+	"github.com/project-auxo/auxo/olympus/pkg/util"
+)
+
+var log = logging.Base()
+
+func main() {
+	var base string
+	flag.StringVar(&base, "out", "olympus",
+		"path of the keypair, written to <out>.key and <out>.key_secret")
+	flag.Parse()
+
+	if !zmq.HasCurve() {
+		log.Fatalf("libzmq was built without CURVE support")
+	}
+	publicKey, err := util.WriteCurveKeypair(base)
+	if err != nil {
+		log.Fatalf("failed to write the keypair: %v", err)
+	}
+	fmt.Printf("Wrote %s.key and %s.key_secret\nPublic key: %s\n", base, base, publicKey)
+}
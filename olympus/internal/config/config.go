@@ -1,16 +1,99 @@
 package config
 
+import (
+	"time"
+
+	"github.com/project-auxo/auxo/olympus/pkg/util"
+)
+
+// Service configures how the broker routes the requests of a service.
+type Service struct {
+	// One of round_robin (default), least_outstanding, power_of_two or
+	// consistent_hash.
+	Balancer string `yaml:"balancer"`
+	// How long an agent has to reply before the request is retried.
+	ReplyTimeout time.Duration `yaml:"reply_timeout"`
+	// How many times a request is retried on another agent before it is
+	// moved to the dead-letter queue.
+	Retries int `yaml:"retries"`
+	// How many requests of the service may be queued or in flight at once,
+	// unlimited when 0.
+	MaxInFlight int `yaml:"max_in_flight"`
+	// Full protobuf names of the payload types the service accepts in
+	// requests and returns in replies, unchecked when empty.
+	RequestTypes []string `yaml:"request_types"`
+	ReplyTypes   []string `yaml:"reply_types"`
+}
+
+// RateLimit caps the rate of requests from each client or agent.
+type RateLimit struct {
+	// Requests per second, unlimited when 0.
+	Rate float64 `yaml:"rate"`
+	// Requests allowed in a burst, one second worth when 0.
+	Burst int `yaml:"burst"`
+}
+
+// Peer is another broker requests may be forwarded to.
+type Peer struct {
+	// Name of the peer, which it connects and advertises its summaries with.
+	Name     string `yaml:"name"`
+	Endpoint string `yaml:"endpoint"`
+	// Public key of the peer, required when the peer uses CURVE.
+	PublicKeyFile string `yaml:"public_key_file"`
+}
+
+// Member is an Olympus instance of the same cluster.
+type Member struct {
+	ID string `yaml:"id"`
+	// Where the member publishes its heartbeats and state.
+	Endpoint string `yaml:"endpoint"`
+}
+
+// Cluster runs Olympus on several instances, one of which leads while the
+// others mirror its state and take over if it fails.
+type Cluster struct {
+	// Identifier of this instance, the cluster is disabled when empty. When
+	// the leader fails, the live instance with the lowest identifier takes
+	// over, provided it sees a majority of the cluster.
+	ID       string   `yaml:"id"`
+	Endpoint string   `yaml:"endpoint"`
+	Members  []Member `yaml:"members"` // The other instances
+}
+
+// Curve secures the broker socket with CurveZMQ.
+type Curve struct {
+	// Secret key of the broker, CURVE is disabled when empty.
+	SecretKeyFile string `yaml:"secret_key_file"`
+	// Public keys of the agents, clients and peers allowed to connect, one per
+	// line.
+	AllowedKeysFile string `yaml:"allowed_keys_file"`
+}
+
 type Config struct {
 	Broker struct {
-		Hostname       string `yaml:"hostname"`
-		Port           int    `yaml:"port"`
+		// Name of the broker among its peers, the hostname when unset.
+		Name           string             `yaml:"name"`
+		Hostname       string             `yaml:"hostname"`
+		Port           int                `yaml:"port"`
+		RequestTimeout time.Duration      `yaml:"request_timeout"`
+		Services       map[string]Service `yaml:"services"`
+		RateLimit      RateLimit          `yaml:"rate_limit"`
+		JournalPath    string             `yaml:"journal_path"`
+		DrainTimeout   time.Duration      `yaml:"drain_timeout"`
+		PriorityAging  time.Duration      `yaml:"priority_aging"`
+		Peers          []Peer             `yaml:"peers"`
+		Cluster        Cluster            `yaml:"cluster"`
+		Curve          Curve              `yaml:"curve"`
 		FrontendServer struct {
-			Hostname string `yaml:"hostname"`
-			Port     int    `yaml:"port"`
+			Hostname string         `yaml:"hostname"`
+			Port     int            `yaml:"port"`
+			TLS      util.TLSConfig `yaml:"tls"`
 		} `yaml:"frontend_server"`
 		BackendClient struct {
-			Hostname string `yaml:"hostname"`
-			Port     int    `yaml:"port"`
+			Hostname string         `yaml:"hostname"`
+			Port     int            `yaml:"port"`
+			CacheTTL time.Duration  `yaml:"cache_ttl"`
+			TLS      util.TLSConfig `yaml:"tls"`
 		} `yaml:"backend_client"`
 	} `yaml:"broker"`
 }
@@ -36,7 +36,7 @@ func main() {
 
 	broker, err := broker.New(cfg)
 	if err != nil {
-		log.Fatalln("Failed to start the broker")
+		log.Fatalf("Failed to start the broker: %v", err)
 	}
 	broker.Run()
 }
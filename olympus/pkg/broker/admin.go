@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
+)
+
+// The admin methods below must be called with broker.mu held.
+
+// audit records an operator action on an agent.
+func (broker *Broker) audit(action string, a *agent, operator, reason string) {
+	broker.log.Infof("[audit] %s agent %s (%s) by %q: %s", action, a.name, a, operator, reason)
+}
+
+// disconnectAgent tells the agent it is disconnected and retries its in-flight
+// requests on other agents.
+func (broker *Broker) disconnectAgent(a *agent, reason string) {
+	broker.send(a.identity, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_DISCONNECT,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Disconnect{
+			Disconnect: &discpb.Disconnect{Reason: reason}},
+	})
+	broker.deleteAgent(a.identity, pb.AgentEvent_DISCONNECTED)
+}
+
+// quarantineAgent stops routing requests to an active agent, or resumes
+// routing to a quarantined one on release.
+func (broker *Broker) quarantineAgent(a *agent, release bool) {
+	switch {
+	case release && a.state == pb.Agent_QUARANTINED:
+		a.state = pb.Agent_ACTIVE
+		broker.joinServices(a)
+		broker.offerAgent(a)
+	case !release && a.state == pb.Agent_ACTIVE:
+		a.state = pb.Agent_QUARANTINED
+		broker.withdrawAgent(a)
+		broker.leaveServices(a)
+	default:
+		return
+	}
+	broker.publish(pb.AgentEvent_STATE_CHANGED, a)
+}
+
+// drainAgent stops routing requests to the agent and asks it to disconnect
+// once done with its in-flight requests, by the deadline. Agents that can't
+// drain are disconnected by the broker once done instead.
+func (broker *Broker) drainAgent(a *agent, deadline time.Time, reason string) {
+	a.state = pb.Agent_DRAINING
+	a.drainDeadline = deadline
+	a.drainReason = reason
+	broker.withdrawAgent(a)
+	broker.leaveServices(a)
+	broker.publish(pb.AgentEvent_STATE_CHANGED, a)
+	if !a.supports(util.FeatureDrain) {
+		broker.releaseDrained(a)
+		return
+	}
+	broker.send(a.identity, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_DISCONNECT,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Disconnect{Disconnect: &discpb.Disconnect{
+			ExpirationTime: timestamppb.New(deadline),
+			Reason:         reason,
+		}},
+	})
+}
+
+// releaseDrained disconnects a draining agent that can't drain itself, once it
+// is done with its in-flight requests.
+func (broker *Broker) releaseDrained(a *agent) {
+	if a.state == pb.Agent_DRAINING && !a.supports(util.FeatureDrain) && len(a.inFlight) == 0 {
+		broker.log.Infof("Agent %s is drained", a)
+		broker.disconnectAgent(a, a.drainReason)
+	}
+}
+
+// expireDrainingAgents disconnects the draining agents that did not leave by
+// their deadline, leaving those that drain themselves a heartbeat expiry more
+// to say goodbye.
+func (broker *Broker) expireDrainingAgents() {
+	now := time.Now()
+	for _, a := range broker.agents {
+		if a.state != pb.Agent_DRAINING {
+			continue
+		}
+		deadline := a.drainDeadline
+		if a.supports(util.FeatureDrain) {
+			deadline = deadline.Add(heartbeatExpiry)
+		}
+		if now.After(deadline) {
+			broker.log.Warnf("Agent %s did not leave after draining", a)
+			broker.disconnectAgent(a, a.drainReason)
+		}
+	}
+}
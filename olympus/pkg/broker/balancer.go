@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	roundRobin       = "round_robin"
+	leastOutstanding = "least_outstanding"
+	powerOfTwo       = "power_of_two"
+	consistentHash   = "consistent_hash"
+
+	// Points per agent on the consistent hashing ring.
+	virtualNodes = 64
+)
+
+// balancer picks the agent a request is dispatched to. The candidates are
+// the waiting agents matching the request, longest waiting first, and never
+// empty. Returning nil leaves the request queued until an agent frees up.
+//
+// The members of a balancer are the active agents offering its service,
+// whether they are waiting or busy.
+type balancer interface {
+	pick(candidates []*agent, req *request) *agent
+	add(a *agent)
+	remove(a *agent)
+}
+
+// memberless is embedded by the balancers that only look at the candidates.
+type memberless struct{}
+
+func (memberless) add(a *agent)    {}
+func (memberless) remove(a *agent) {}
+
+func newBalancer(name string) (balancer, error) {
+	switch name {
+	case "", roundRobin:
+		return roundRobinBalancer{}, nil
+	case leastOutstanding:
+		return leastOutstandingBalancer{}, nil
+	case powerOfTwo:
+		return &powerOfTwoBalancer{
+			rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case consistentHash:
+		return &consistentHashBalancer{members: make(map[*agent]bool)}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", name)
+}
+
+// roundRobinBalancer picks the longest waiting agent. As agents go to the
+// back of the waiting list once they are picked, they take turns.
+type roundRobinBalancer struct{ memberless }
+
+func (roundRobinBalancer) pick(candidates []*agent, req *request) *agent {
+	return candidates[0]
+}
+
+// leastOutstandingBalancer picks the agent working on the fewest requests.
+type leastOutstandingBalancer struct{ memberless }
+
+func (leastOutstandingBalancer) pick(candidates []*agent, req *request) *agent {
+	best := candidates[0]
+	for _, a := range candidates[1:] {
+		if len(a.inFlight) < len(best.inFlight) {
+			best = a
+		}
+	}
+	return best
+}
+
+// powerOfTwoBalancer picks the less loaded of two random agents, which comes
+// close to least outstanding without always piling onto the same agent.
+type powerOfTwoBalancer struct {
+	memberless
+	rand *rand.Rand
+}
+
+func (b *powerOfTwoBalancer) pick(candidates []*agent, req *request) *agent {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := b.rand.Intn(len(candidates))
+	j := b.rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if len(candidates[j].inFlight) < len(candidates[i].inFlight) {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// consistentHashBalancer sends requests with the same key to the same agent,
+// the owner of the key on a ring of all the members, so that keys only move
+// when members come and go. Requests for a busy owner wait for it, those the
+// owner can't take, e.g. for its labels, go to the next agent on the ring
+// that can. Requests without a key are balanced round robin.
+type consistentHashBalancer struct {
+	members map[*agent]bool
+	ring    []ringPoint // Sorted by hash, nil when the members changed
+}
+
+type ringPoint struct {
+	hash  uint64
+	agent *agent
+}
+
+func (b *consistentHashBalancer) add(a *agent) {
+	if !b.members[a] {
+		b.members[a] = true
+		b.ring = nil
+	}
+}
+
+func (b *consistentHashBalancer) remove(a *agent) {
+	if b.members[a] {
+		delete(b.members, a)
+		b.ring = nil
+	}
+}
+
+func (b *consistentHashBalancer) pick(candidates []*agent, req *request) *agent {
+	key := req.msg.GetKey()
+	if key == "" || len(b.members) == 0 {
+		return candidates[0]
+	}
+	if b.ring == nil {
+		b.buildRing()
+	}
+	waiting := make(map[*agent]bool, len(candidates))
+	for _, a := range candidates {
+		waiting[a] = true
+	}
+	h := hashKey(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	// Retries skip the agents that already had the request, unless they all
+	// did.
+	for _, skipTried := range []bool{true, false} {
+		for i := range b.ring {
+			a := b.ring[(start+i)%len(b.ring)].agent
+			if !req.accepts(a) || (skipTried && req.tried[a.identity]) {
+				continue
+			}
+			if waiting[a] {
+				return a
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// buildRing places virtualNodes points per member on the ring.
+func (b *consistentHashBalancer) buildRing() {
+	b.ring = make([]ringPoint, 0, len(b.members)*virtualNodes)
+	for a := range b.members {
+		for i := 0; i < virtualNodes; i++ {
+			b.ring = append(b.ring, ringPoint{hashKey(a.identity + "#" + strconv.Itoa(i)), a})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		if b.ring[i].hash != b.ring[j].hash {
+			return b.ring[i].hash < b.ring[j].hash
+		}
+		return b.ring[i].agent.identity < b.ring[j].agent.identity
+	})
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV hardly spreads the last bytes of a key over the high bits, which
+	// the ring is sorted by, so the points of an agent would bunch up. The
+	// finalizer of MurmurHash3 mixes them in.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,174 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+// fakeAgents returns n idle agents.
+func fakeAgents(n int) (agents []*agent) {
+	for i := 0; i < n; i++ {
+		agents = append(agents, &agent{
+			identity:       fmt.Sprintf("agent-%d", i),
+			maxConcurrency: 1,
+			inFlight:       make(map[string]*request),
+		})
+	}
+	return
+}
+
+func keyedRequest(key string) *request {
+	return &request{msg: &discpb.Request{Key: key}, tried: make(map[string]bool)}
+}
+
+func newTestBalancer(t *testing.T, name string, members []*agent) balancer {
+	t.Helper()
+	b, err := newBalancer(name)
+	if err != nil {
+		t.Fatalf("newBalancer(%q): %v", name, err)
+	}
+	for _, a := range members {
+		b.add(a)
+	}
+	return b
+}
+
+func TestRoundRobinPicksLongestWaiting(t *testing.T) {
+	agents := fakeAgents(3)
+	b := newTestBalancer(t, roundRobin, agents)
+	if got := b.pick(agents, keyedRequest("")); got != agents[0] {
+		t.Errorf("pick() = %v, want %v", got, agents[0])
+	}
+}
+
+func TestLeastOutstandingPicksLeastLoaded(t *testing.T) {
+	agents := fakeAgents(3)
+	agents[0].inFlight["1"] = &request{}
+	agents[1].inFlight["2"] = &request{}
+	agents[1].inFlight["3"] = &request{}
+	b := newTestBalancer(t, leastOutstanding, agents)
+	if got := b.pick(agents, keyedRequest("")); got != agents[2] {
+		t.Errorf("pick() = %v, want %v", got, agents[2])
+	}
+}
+
+func TestPowerOfTwoPicksCandidate(t *testing.T) {
+	agents := fakeAgents(4)
+	b := newTestBalancer(t, powerOfTwo, agents)
+	for i := 0; i < 100; i++ {
+		got := b.pick(agents[1:], keyedRequest(""))
+		if got == agents[0] || got == nil {
+			t.Fatalf("pick() = %v, want one of the candidates", got)
+		}
+	}
+}
+
+func TestConsistentHashIsSticky(t *testing.T) {
+	agents := fakeAgents(5)
+	b := newTestBalancer(t, consistentHash, agents)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		first := b.pick(agents, keyedRequest(key))
+		// The order of the waiting agents doesn't matter.
+		reversed := []*agent{agents[4], agents[3], agents[2], agents[1], agents[0]}
+		if again := b.pick(reversed, keyedRequest(key)); again != first {
+			t.Fatalf("key %s went to %v, then to %v", key, first, again)
+		}
+	}
+}
+
+func TestConsistentHashWaitsForBusyOwner(t *testing.T) {
+	agents := fakeAgents(3)
+	b := newTestBalancer(t, consistentHash, agents)
+	owner := b.pick(agents, keyedRequest("sim-42"))
+	var others []*agent
+	for _, a := range agents {
+		if a != owner {
+			others = append(others, a)
+		}
+	}
+	if got := b.pick(others, keyedRequest("sim-42")); got != nil {
+		t.Errorf("pick() = %v while the owner %v is busy, want nil", got, owner)
+	}
+}
+
+func TestConsistentHashRetriesOnNextAgent(t *testing.T) {
+	agents := fakeAgents(3)
+	b := newTestBalancer(t, consistentHash, agents)
+	req := keyedRequest("sim-42")
+	owner := b.pick(agents, req)
+	req.tried[owner.identity] = true
+	got := b.pick(agents, req)
+	if got == nil || got == owner {
+		t.Errorf("retry went to %v, want an agent other than the owner %v", got, owner)
+	}
+}
+
+func TestConsistentHashSkipsUnmatchedOwner(t *testing.T) {
+	agents := fakeAgents(3)
+	b := newTestBalancer(t, consistentHash, agents)
+	owner := b.pick(agents, keyedRequest("sim-42"))
+	owner.labels = map[string]string{"tier": "canary"}
+	req := keyedRequest("sim-42")
+	req.selector, _ = parseLabelSelector("tier!=canary")
+	var matching []*agent
+	for _, a := range agents {
+		if a != owner {
+			matching = append(matching, a)
+		}
+	}
+	if got := b.pick(matching, req); got == nil || got == owner {
+		t.Errorf("pick() = %v, want an agent other than the unmatched owner %v", got, owner)
+	}
+}
+
+func TestConsistentHashMovesFewKeys(t *testing.T) {
+	agents := fakeAgents(5)
+	b := newTestBalancer(t, consistentHash, agents[:4])
+	const keys = 1000
+	before := make(map[string]*agent)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = b.pick(agents[:4], keyedRequest(key))
+	}
+
+	// A new member only takes keys from the others.
+	b.add(agents[4])
+	moved := 0
+	for key, owner := range before {
+		got := b.pick(agents, keyedRequest(key))
+		if got == owner {
+			continue
+		}
+		if got != agents[4] {
+			t.Fatalf("key %s moved from %v to %v, not to the new member", key, owner, got)
+		}
+		moved++
+	}
+	if moved == 0 || moved > keys/2 {
+		t.Errorf("%d of %d keys moved to the new member", moved, keys)
+	}
+
+	// A member leaving only gives up its own keys.
+	b.remove(agents[4])
+	b.remove(agents[0])
+	for key, owner := range before {
+		got := b.pick(agents[1:4], keyedRequest(key))
+		if owner != agents[0] && got != owner {
+			t.Fatalf("key %s moved from %v to %v", key, owner, got)
+		}
+		if got == agents[0] {
+			t.Fatalf("key %s went to %v, which left", key, got)
+		}
+	}
+}
+
+func TestConsistentHashWithoutKeyIsRoundRobin(t *testing.T) {
+	agents := fakeAgents(3)
+	b := newTestBalancer(t, consistentHash, agents)
+	if got := b.pick(agents[1:], keyedRequest("")); got != agents[1] {
+		t.Errorf("pick() = %v, want %v", got, agents[1])
+	}
+}
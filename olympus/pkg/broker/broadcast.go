@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
+)
+
+// broadcast gathers the replies of every agent a broadcast request was sent
+// to, until the quorum is met or every agent replied or failed.
+type broadcast struct {
+	pending   map[string]bool // Identities of the agents yet to reply
+	replies   []*discpb.AgentReply
+	succeeded int
+	quorum    int
+	done      bool // Set once the aggregated reply is sent
+}
+
+// The broadcast methods below must be called with broker.mu held.
+
+// scatter sends the request to every active agent offering its service and
+// matching its label selector.
+func (broker *Broker) scatter(req *request) {
+	var matching []*agent
+	for _, a := range broker.agents {
+		if a.state == pb.Agent_ACTIVE && a.offers(req.msg.GetServiceName()) &&
+			req.selector.matches(a.labels) {
+			matching = append(matching, a)
+		}
+	}
+	if len(matching) == 0 {
+		broker.sendError(req.client, req.msg, req.clientID, discpb.Error_NO_MATCHING_AGENT,
+			fmt.Sprintf("no agent for service %q matching %q",
+				req.msg.GetServiceName(), req.msg.GetLabelSelector()))
+		return
+	}
+	b := &broadcast{pending: make(map[string]bool), quorum: int(req.msg.GetQuorum())}
+	if b.quorum == 0 {
+		b.quorum = len(matching)
+	}
+	req.broadcast = b
+	req.attempts = 1
+	req.deadline = time.Now().Add(broker.replyTimeout(req))
+	for _, a := range matching {
+		b.pending[a.identity] = true
+		req.tried[a.identity] = true
+		// Broadcasts don't wait for spare capacity, but take it up.
+		broker.withdrawAgent(a)
+		a.inFlight[req.id] = req
+		broker.waitAgent(a)
+		broker.sendRequest(a, req)
+	}
+}
+
+// gather records the reply of an agent to a broadcast request.
+func (broker *Broker) gather(req *request, a *agent, msg *discpb.Reply) {
+	b := req.broadcast
+	delete(b.pending, a.identity)
+	reply := &discpb.AgentReply{
+		Name:     a.name,
+		Identity: []byte(a.identity),
+		Payload:  msg.GetPayload(),
+		Error:    msg.GetError(),
+	}
+	if reply.Error == nil {
+		b.succeeded++
+	}
+	b.replies = append(b.replies, reply)
+	broker.finishBroadcast(req)
+}
+
+// gatherFailure records that an agent failed to reply to a broadcast request.
+func (broker *Broker) gatherFailure(
+	req *request, a *agent, code discpb.Error_Code, reason string) {
+	b := req.broadcast
+	delete(b.pending, a.identity)
+	b.replies = append(b.replies, &discpb.AgentReply{
+		Name:     a.name,
+		Identity: []byte(a.identity),
+		Error:    &discpb.Error{Code: code, Message: reason},
+	})
+	broker.finishBroadcast(req)
+}
+
+// finishBroadcast sends the aggregated reply once the quorum is met, or once
+// it can no longer be.
+func (broker *Broker) finishBroadcast(req *request) {
+	b := req.broadcast
+	if b.done || (b.succeeded < b.quorum && len(b.pending) > 0) {
+		return
+	}
+	b.done = true
+	reply := &discpb.Reply{
+		ServiceName:   req.msg.GetServiceName(),
+		Id:            req.clientID,
+		Replies:       b.replies,
+		CorrelationId: req.msg.GetCorrelationId(),
+	}
+	if b.succeeded < b.quorum {
+		reply.Error = &discpb.Error{
+			Code: discpb.Error_QUORUM_NOT_MET,
+			Message: fmt.Sprintf("%d of %d agent(s) replied successfully, %d required",
+				b.succeeded, len(b.replies), b.quorum),
+		}
+	}
+	broker.getService(req.msg.GetServiceName()).stats.replies++
+	msg := &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_REPLY,
+		Origin:  &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Reply{Reply: reply},
+	}
+	if err := broker.send(req.client, msg); err != nil {
+		broker.log.Warnf("failed to return broadcast reply %s to %x: %v",
+			req.id, req.client, err)
+	}
+}
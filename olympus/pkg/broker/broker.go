@@ -6,35 +6,100 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	zmq "github.com/pebbe/zmq4"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/proto"
 
 	brokerConfig "github.com/project-auxo/auxo/olympus/internal/config"
 	"github.com/project-auxo/auxo/olympus/logging"
+	"github.com/project-auxo/auxo/olympus/pkg/journal"
+	"github.com/project-auxo/auxo/olympus/pkg/payload"
 	util "github.com/project-auxo/auxo/olympus/pkg/util"
 	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
 	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
 )
 
 const (
-	heartbeatInterval = time.Duration(1) * time.Second
-	entityType        = discpb.Entity_BROKER
+	defaultRequestTimeout = time.Duration(30) * time.Second
+	defaultReplyTimeout   = time.Duration(30) * time.Second
+	heartbeatInterval     = time.Duration(1) * time.Second
+	heartbeatLiveness     = 3 // Missed heartbeats before an agent is expired
+	heartbeatExpiry       = heartbeatInterval * heartbeatLiveness
+	entityType            = discpb.Entity_BROKER
+	wakeEndpoint          = "inproc://olympus-wake-%d" // Numbered by brokerCount
+	commandBufferSize     = 16
+	legacyExpiry          = time.Hour
+)
+
+// Brokers created by the process, so that each can have its own wake-up
+// endpoint and ZAP domain.
+var brokerCount uint64
+
+var (
+	_heartbeatMsg = &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_HEARTBEAT,
+		Origin:  &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Heartbeat{Heartbeat: &discpb.Heartbeat{}},
+	}
+	_disconnectMsg = &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_DISCONNECT,
+		Origin:  &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Disconnect{Disconnect: &discpb.Disconnect{}},
+	}
 )
 
 type Broker struct {
 	log              logging.Logger
+	name             string // Name of the broker among its peers
 	socket           *zmq.Socket
 	poller           *zmq.Poller
 	hostname         string
 	port             int
 	frontendHostname string
 	frontendPort     int
+	frontendOpts     []grpc.ServerOption
 	endpoint         string
 	entityType       discpb.Entity_Type
+	validator        *serviceValidator // Nil when services aren't validated
+	requestTimeout   time.Duration     // How long requests wait for an agent
+	drainTimeout     time.Duration     // How long shutdown waits for replies
+	priorityAging    time.Duration     // How long until a queued request is promoted
+	serviceCfgs      map[string]brokerConfig.Service
+	payloads         *payload.Registry
+	rateLimit        brokerConfig.RateLimit
+	journal          *journal.Journal // Nil when durable requests are refused
+	curve            *curveKeypair    // Nil when connections are plaintext
+
+	// Other goroutines hand work to the broker loop through do.
+	commands     chan func()
+	stopped      chan struct{} // Closed when the broker loop exits
+	quit         bool          // Set on the broker loop to make it exit
+	wakeMu       sync.Mutex    // Guards wakeSender
+	wakeSender   *zmq.Socket
+	wakeReceiver *zmq.Socket
+	// Senders speaking a version older than this build, which may predate
+	// envelopes, keyed by identity. Owned by the broker loop.
+	legacy map[string]legacySender
+
+	mu            sync.Mutex          // Guards the fields below
+	agents        map[string]*agent   // Keyed by ZMQ routing identity
+	services      map[string]*service // Keyed by service name
+	watchers      map[*watcher]struct{}
+	deadLetters   []*deadLetter // Oldest first
+	nextRequestID uint64
+	peers         map[string]*peer   // Keyed by peer name
+	senders       map[string]*sender // Rate limited senders, keyed by identity
+	validating    map[string]bool    // Identities whose READY is being validated
+	idleLimited   uint64             // Rate limited requests of forgotten senders
+	cluster       *cluster           // Nil when running a single instance
+	draining      bool               // No new work is taken on while draining
+	drainDeadline time.Time
 }
 
 func New(cfg *brokerConfig.Config) (broker *Broker, err error) {
@@ -45,18 +110,100 @@ func New(cfg *brokerConfig.Config) (broker *Broker, err error) {
 	}
 	port := cfg.Broker.Port
 	endpoint := fmt.Sprintf("tcp://%s:%d", hostname, port)
+	name := cfg.Broker.Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
 	broker = &Broker{
 		log:              logging.Base(),
+		name:             name,
 		hostname:         hostname,
 		port:             port,
 		frontendHostname: cfg.Broker.FrontendServer.Hostname,
 		frontendPort:     cfg.Broker.FrontendServer.Port,
 		endpoint:         endpoint,
 		entityType:       entityType,
+		requestTimeout:   cfg.Broker.RequestTimeout,
+		drainTimeout:     cfg.Broker.DrainTimeout,
+		priorityAging:    cfg.Broker.PriorityAging,
+		serviceCfgs:      cfg.Broker.Services,
+		payloads:         payload.NewRegistry(),
+		rateLimit:        cfg.Broker.RateLimit,
 		poller:           zmq.NewPoller(),
+		agents:           make(map[string]*agent),
+		services:         make(map[string]*service),
+		watchers:         make(map[*watcher]struct{}),
+		peers:            make(map[string]*peer),
+		senders:          make(map[string]*sender),
+		validating:       make(map[string]bool),
+		commands:         make(chan func(), commandBufferSize),
+		stopped:          make(chan struct{}),
+		legacy:           make(map[string]legacySender),
+	}
+	if broker.frontendOpts, err = util.ServerOptions(cfg.Broker.FrontendServer.TLS); err != nil {
+		return nil, fmt.Errorf("frontend server: %v", err)
+	}
+	for name, srvCfg := range broker.serviceCfgs {
+		if _, err = newBalancer(srvCfg.Balancer); err != nil {
+			return nil, fmt.Errorf("service %q: %v", name, err)
+		}
+		broker.payloads.RegisterNames(name, srvCfg.RequestTypes, srvCfg.ReplyTypes)
+	}
+	if broker.requestTimeout == 0 {
+		broker.requestTimeout = defaultRequestTimeout
+	}
+	if broker.drainTimeout == 0 {
+		broker.drainTimeout = defaultDrainTimeout
+	}
+	if broker.priorityAging == 0 {
+		broker.priorityAging = defaultPriorityAging
+	}
+	if cfg.Broker.BackendClient.Hostname != "" {
+		broker.validator = newServiceValidator(cfg)
+	}
+	if cfg.Broker.JournalPath != "" {
+		if err = broker.openJournal(cfg.Broker.JournalPath); err != nil {
+			return nil, fmt.Errorf("open journal: %v", err)
+		}
+		// In a cluster, the journal is replayed once the broker leads.
+		if cfg.Broker.Cluster.ID == "" {
+			broker.mu.Lock()
+			broker.replayJournal()
+			broker.mu.Unlock()
+		}
 	}
 	broker.socket, err = zmq.NewSocket(zmq.ROUTER)
+	if err != nil {
+		return
+	}
 	broker.poller.Add(broker.socket, zmq.POLLIN)
+	seq := atomic.AddUint64(&brokerCount, 1)
+	if cfg.Broker.Curve.SecretKeyFile != "" {
+		if err = broker.setupCurve(cfg.Broker.Curve, fmt.Sprintf(curveDomain, seq)); err != nil {
+			return
+		}
+	}
+
+	if broker.wakeReceiver, err = zmq.NewSocket(zmq.PULL); err != nil {
+		return
+	}
+	wake := fmt.Sprintf(wakeEndpoint, seq)
+	if err = broker.wakeReceiver.Bind(wake); err != nil {
+		return
+	}
+	if broker.wakeSender, err = zmq.NewSocket(zmq.PUSH); err != nil {
+		return
+	}
+	if err = broker.wakeSender.Connect(wake); err != nil {
+		return
+	}
+	broker.poller.Add(broker.wakeReceiver, zmq.POLLIN)
+	if err = broker.connectPeers(cfg.Broker.Peers); err != nil {
+		return
+	}
+	if cfg.Broker.Cluster.ID != "" {
+		err = broker.joinCluster(cfg.Broker.Cluster)
+	}
 	return
 }
 
@@ -71,45 +218,335 @@ func (broker *Broker) bind(endpoint string) (err error) {
 	return
 }
 
-// Close will cleanly close the broker's socket.
+// Close will cleanly close the broker's sockets.
 func (broker *Broker) close() (err error) {
 	if broker.socket != nil {
 		err = broker.socket.Close()
 		broker.socket = nil
 	}
+	if broker.wakeSender != nil {
+		broker.wakeSender.Close()
+		broker.wakeSender = nil
+	}
+	if broker.wakeReceiver != nil {
+		broker.wakeReceiver.Close()
+		broker.wakeReceiver = nil
+	}
+	for _, p := range broker.peers {
+		p.socket.Close()
+	}
+	if broker.cluster != nil {
+		broker.cluster.close()
+	}
+	if broker.curve != nil {
+		broker.curve.close()
+	}
+	if broker.journal != nil {
+		broker.journal.Close()
+	}
 	return
 }
 
 func (broker *Broker) handle() {
+	defer close(broker.stopped)
+	heartbeatAt := time.Now().Add(heartbeatInterval)
 	for {
 		polled, err := broker.poller.Poll(heartbeatInterval)
 		if err != nil {
 			// Interrupted
 			break
 		}
-		if len(polled) > 0 {
-			recvBytes, err := broker.socket.RecvBytes(0)
-			if err != nil {
-				break
+		for _, socket := range polled {
+			switch s := socket.Socket; s {
+			case broker.socket:
+				if err := broker.recv(); err != nil {
+					broker.log.Warnf("failed to receive: %v", err)
+				}
+			case broker.wakeReceiver:
+				broker.runCommands()
+			default:
+				if broker.cluster != nil && s == broker.cluster.sub {
+					if err := broker.recvCluster(); err != nil {
+						broker.log.Warnf("failed to receive from the cluster: %v", err)
+					}
+				} else if p := broker.peerBySocket(s); p != nil {
+					if err := broker.recvPeer(p); err != nil {
+						broker.log.Warnf("failed to receive from peer %s: %v", p, err)
+					}
+				}
 			}
-			discoveryMsg, err := util.UnmarshalDiscoveryMessage(recvBytes)
-			_ = discoveryMsg
-			broker.log.Debugln("Received a message")
+		}
+		if broker.quit {
+			break
+		}
+
+		// Expire silent agents and stale requests, and let the other agents
+		// know we're still alive.
+		if time.Now().After(heartbeatAt) {
+			broker.mu.Lock()
+			broker.clusterTick()
+			if broker.isLeader() {
+				broker.tick()
+			}
+			broker.mu.Unlock()
+			heartbeatAt = time.Now().Add(heartbeatInterval)
 		}
 	}
 }
 
-func (broker *Broker) runFrontendServer() {
-	var runChan = make(chan os.Signal, 1)
-	signal.Notify(runChan, os.Interrupt, syscall.SIGTSTP)
+// tick does the periodic work of a broker serving agents. Must be called with
+// broker.mu held.
+func (broker *Broker) tick() {
+	for _, a := range broker.purgeAgents() {
+		broker.log.Warnf("Agent %s expired after %v of silence", a, heartbeatExpiry)
+	}
+	broker.expireRequests()
+	broker.agePriorities()
+	broker.checkDeadlines()
+	broker.expireDrainingAgents()
+	broker.forgetSenders()
+	broker.forgetLegacy()
+	broker.checkForwarded()
+	broker.sendSummaries()
+	for identity := range broker.agents {
+		if err := broker.send(identity, _heartbeatMsg); err != nil {
+			broker.log.Warnf("failed to heartbeat agent %x: %v", identity, err)
+		}
+	}
+}
 
+// recv handles the next message on the ROUTER socket.
+func (broker *Broker) recv() (err error) {
+	// The ROUTER socket prepends the sender's identity frame. With CURVE, the
+	// user ID is the sender's public key.
+	frames, metadata, err := broker.socket.RecvMessageBytesWithMetadata(0, "User-Id")
+	if err != nil {
+		return
+	}
+	if len(frames) < 2 {
+		return fmt.Errorf("malformed message of %d frame(s)", len(frames))
+	}
+	identity := string(frames[0])
+	body, version, err := util.OpenEnvelope(frames[1:])
+	if err != nil {
+		return fmt.Errorf("message from %x: %v", identity, err)
+	}
+	if version < util.ProtocolVersion {
+		broker.legacy[identity] = legacySender{version: version, heardAt: time.Now()}
+	} else {
+		delete(broker.legacy, identity)
+	}
+	discoveryMsg, err := util.UnmarshalDiscoveryMessage(body)
+	if err != nil {
+		return fmt.Errorf("message from %x: %v", identity, err)
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if !broker.admit(identity, discoveryMsg) {
+		return
+	}
+	p := broker.peerFor(identity, metadata["User-Id"])
+	broker.handleMessage(identity, p, discoveryMsg)
+	return
+}
+
+// do runs fn on the broker loop, which owns the ROUTER socket, with broker.mu
+// held, and waits for it to complete. It returns false if the loop is no
+// longer running. The caller must not hold broker.mu.
+func (broker *Broker) do(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case broker.commands <- func() { fn(); close(done) }:
+	case <-broker.stopped:
+		return false
+	}
+	broker.wakeMu.Lock()
+	broker.wakeSender.Send("", zmq.DONTWAIT)
+	broker.wakeMu.Unlock()
+	select {
+	case <-done:
+		return true
+	case <-broker.stopped:
+		return false
+	}
+}
+
+// runCommands runs the functions queued by do.
+func (broker *Broker) runCommands() {
+	// Drain the wake-ups, one command may have been queued per wake-up.
+	for {
+		if _, err := broker.wakeReceiver.Recv(zmq.DONTWAIT); err != nil {
+			break
+		}
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for {
+		select {
+		case fn := <-broker.commands:
+			fn()
+		default:
+			return
+		}
+	}
+}
+
+func (broker *Broker) send(identity string, msg *discpb.DiscoveryMessage) (err error) {
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		return
+	}
+	_, err = broker.socket.SendMessage(identity, util.Envelope(broker.versionOf(identity), msgBytes))
+	return
+}
+
+// legacySender is a sender speaking a version older than this build.
+type legacySender struct {
+	version uint32 // Of its last envelope, 0 when it sent the body alone
+	heardAt time.Time
+}
+
+// versionOf returns the version to frame the messages to the identity with:
+// the version negotiated with an agent, or else the one the sender last spoke.
+// Must be called with broker.mu held.
+func (broker *Broker) versionOf(identity string) uint32 {
+	if a, found := broker.agents[identity]; found {
+		return a.protocolVersion
+	}
+	if sender, found := broker.legacy[identity]; found {
+		return sender.version
+	}
+	return util.ProtocolVersion
+}
+
+// forgetLegacy drops the legacy senders that have been silent for long, and
+// aren't registered agents. Runs on the broker loop.
+func (broker *Broker) forgetLegacy() {
+	for identity, sender := range broker.legacy {
+		if _, found := broker.agents[identity]; !found && time.Since(sender.heardAt) > legacyExpiry {
+			delete(broker.legacy, identity)
+		}
+	}
+}
+
+// admit reports whether an incoming message can be handled right away. The
+// services of a READY are validated with the Oracle first, off the broker
+// loop as that may block, after which the READY is handled. Must be called
+// with broker.mu held.
+func (broker *Broker) admit(identity string, msg *discpb.DiscoveryMessage) bool {
+	if msg.GetHeader() != discpb.Header_HEADER_READY || broker.validator == nil {
+		return true
+	}
+	broker.validating[identity] = true
+	go broker.validateReady(identity, msg)
+	return false
+}
+
+// validateReady hands a READY back to the broker loop once its services are
+// validated, leaving out those missing from the Oracle registry. Agents
+// offering none of their services are rejected.
+func (broker *Broker) validateReady(identity string, msg *discpb.DiscoveryMessage) {
+	ready := msg.GetReady()
+	unknown := broker.validator.unknownServices(ready.GetServices())
+	broker.do(func() {
+		delete(broker.validating, identity)
+		if len(unknown) == 0 {
+			broker.handleMessage(identity, nil, msg)
+			return
+		}
+		var known []string
+		for _, name := range ready.GetServices() {
+			if !contains(unknown, name) {
+				known = append(known, name)
+			}
+		}
+		if len(known) == 0 {
+			broker.reject(identity, fmt.Sprintf("services not in the Oracle registry: %v", unknown))
+			return
+		}
+		broker.log.Warnf("Agent %x offers services not in the Oracle registry, ignoring %v",
+			identity, unknown)
+		ready.Services = known
+		broker.handleMessage(identity, nil, msg)
+	})
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMessage updates the agent registry and routes requests according to
+// the discovery protocol. The peer is nil unless the sender is a peer broker.
+// Must be called with broker.mu held.
+func (broker *Broker) handleMessage(
+	identity string, p *peer, msg *discpb.DiscoveryMessage) {
+	if !broker.isLeader() {
+		broker.turnAway(identity, msg)
+		return
+	}
+	// Any traffic from a registered agent counts as a heartbeat.
+	known := broker.refreshAgent(identity)
+
+	switch msg.GetHeader() {
+	case discpb.Header_HEADER_READY:
+		if broker.draining {
+			broker.send(identity, drainMsg(broker.drainDeadline))
+			return
+		}
+		version, err := util.NegotiateVersion(msg.GetReady().GetProtocolVersion())
+		if err != nil {
+			broker.reject(identity, err.Error())
+			return
+		}
+		if reserved := reservedServices(msg.GetReady().GetServices()); len(reserved) > 0 {
+			broker.reject(identity, fmt.Sprintf("services reserved for the broker: %v", reserved))
+			return
+		}
+		a := broker.registerAgent(identity, msg.GetReady(), version)
+		broker.welcome(a)
+		broker.log.Infof("Agent %s (%s) is ready, speaking version %d, offering %v",
+			a.name, a, a.protocolVersion, a.services)
+	case discpb.Header_HEADER_REQUEST:
+		broker.handleRequest(identity, msg.GetRequest(), p != nil)
+	case discpb.Header_HEADER_REPLY:
+		broker.handleReply(identity, msg.GetReply())
+	case discpb.Header_HEADER_HEARTBEAT:
+		if !known && !broker.validating[identity] {
+			// Most likely the broker restarted underneath the agent, ask it to
+			// reconnect so that it sends a fresh READY.
+			broker.log.Debugf("Heartbeat from unknown agent %x", identity)
+			broker.send(identity, _disconnectMsg)
+		}
+	case discpb.Header_HEADER_CHUNK:
+		broker.handleChunk(identity, msg.GetChunk())
+	case discpb.Header_HEADER_CREDIT:
+		broker.handleCredit(identity, msg.GetCredit())
+	case discpb.Header_HEADER_SUMMARY:
+		broker.handleSummary(identity, p, msg.GetSummary())
+	case discpb.Header_HEADER_DISCONNECT:
+		broker.deleteAgent(identity, pb.AgentEvent_DISCONNECTED)
+		broker.log.Infof("Agent %x disconnected", identity)
+	default:
+		broker.log.Debugf(
+			"Ignoring %s from %x", msg.GetHeader(), identity)
+	}
+}
+
+// runFrontendServer starts serving the frontend, which is stopped through the
+// returned server.
+func (broker *Broker) runFrontendServer() *grpc.Server {
 	frontendEndpoint := fmt.Sprintf(
 		"%s:%d", broker.frontendHostname, broker.frontendPort)
 	lis, err := net.Listen("tcp", frontendEndpoint)
 	if err != nil {
 		broker.log.Fatalf("set up Olympus/HestiaFrontend: %v", err)
 	}
-	s := grpc.NewServer()
+	s := grpc.NewServer(broker.frontendOpts...)
 	pb.RegisterOlympusFrontendServiceServer(s, &olympusFrontendServer{broker: broker})
 
 	go func() {
@@ -120,8 +557,51 @@ func (broker *Broker) runFrontendServer() {
 			broker.log.Fatalf("failed to serve Olympus/HestiaFrontend: %v", err)
 		}
 	}()
+	return s
+}
 
-	<-runChan
+// shutdown drains the broker and waits for the agents to reply to the
+// requests they are working on, until the drain timeout or another signal.
+func (broker *Broker) shutdown(runChan <-chan os.Signal) {
+	deadline := time.Now().Add(broker.drainTimeout)
+	broker.do(func() { broker.drain(deadline) })
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		pending := 0
+		if !broker.do(func() { pending = broker.inFlight() }) || pending == 0 {
+			break
+		}
+		select {
+		case interrupt := <-runChan:
+			broker.log.Warnf("Olympus/Broker is stopping now due to %+v", interrupt)
+			deadline = time.Now()
+		case <-ticker.C:
+		}
+	}
+	broker.do(func() {
+		if n := broker.inFlight(); n > 0 {
+			broker.log.Warnf("Abandoning %d request(s) still in flight", n)
+		}
+		broker.failQueued()
+		broker.quit = true
+	})
+}
+
+// stopFrontendServer lets the in-progress calls complete, unless that takes
+// longer than the drain timeout.
+func (broker *Broker) stopFrontendServer(s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(broker.drainTimeout):
+		s.Stop()
+	}
 }
 
 func (broker *Broker) Run() (err error) {
@@ -136,9 +616,13 @@ func (broker *Broker) Run() (err error) {
 
 	broker.log.Infof("⇨ Olympus/Broker started on %s\n", broker.endpoint)
 	go broker.handle()
-	broker.runFrontendServer()
+	frontend := broker.runFrontendServer()
 
 	interrupt := <-runChan
-	broker.log.Infof("Olympus/Broker is shutting down due to %+v\n", interrupt)
+	broker.log.Infof("Olympus/Broker is draining due to %+v\n", interrupt)
+	broker.shutdown(runChan)
+	broker.stopFrontendServer(frontend)
+	<-broker.stopped
+	broker.log.Infof("Olympus/Broker has shut down")
 	return
 }
@@ -10,10 +10,18 @@ import (
 
 	brokerConfig "github.com/project-auxo/auxo/olympus/internal/config"
 	"github.com/project-auxo/auxo/olympus/logging"
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
 	pb "github.com/project-auxo/auxo/oracle/proto"
 )
 
-const timeOut = time.Minute
+const (
+	// Agents wait on the Oracle while their services are validated.
+	timeOut         = time.Duration(2) * time.Second
+	defaultCacheTTL = time.Duration(5) * time.Minute
+	// How long services are let in without asking the Oracle again, after it
+	// failed to answer.
+	failureTTL = time.Duration(30) * time.Second
+)
 
 var (
 	log    = logging.Base()
@@ -21,18 +29,88 @@ var (
 	client pb.OracleBackendServiceClient // Singleton
 )
 
-func GetOracleClient(cfg *brokerConfig.Config) (pb.OracleBackendServiceClient, context.Context) {
+func GetOracleClient(cfg *brokerConfig.Config) pb.OracleBackendServiceClient {
 	once.Do(func() {
+		creds, err := util.DialOption(cfg.Broker.BackendClient.TLS)
+		if err != nil {
+			log.Fatalf("tls: %v", err)
+		}
 		conn, err := grpc.Dial(
 			fmt.Sprintf(
-				"%s:%d", cfg.Broker.BackendClient.Hostname, cfg.Broker.BackendClient.Port), grpc.WithInsecure())
+				"%s:%d", cfg.Broker.BackendClient.Hostname, cfg.Broker.BackendClient.Port), creds)
 		if err != nil {
 			log.Fatalf("dial: %v", err)
 		}
 		client = pb.NewOracleBackendServiceClient(conn)
 	})
-	ctx, cancel := context.WithTimeout(context.TODO(), timeOut)
+	return client
+}
+
+// serviceValidator checks the services advertised by agents against the
+// Oracle registry. Answers are cached for ttl. While the Oracle fails to
+// answer, services are let in, so that an Oracle outage doesn't keep agents
+// out. It is safe for concurrent use.
+type serviceValidator struct {
+	client pb.OracleBackendServiceClient
+	ttl    time.Duration
+	mu     sync.Mutex             // Guards cache
+	cache  map[string]cachedCheck // Keyed by service name
+}
+
+type cachedCheck struct {
+	exists    bool
+	expiresAt time.Time
+}
+
+func newServiceValidator(cfg *brokerConfig.Config) *serviceValidator {
+	ttl := cfg.Broker.BackendClient.CacheTTL
+	if ttl == 0 {
+		ttl = defaultCacheTTL
+	}
+	return &serviceValidator{
+		client: GetOracleClient(cfg),
+		ttl:    ttl,
+		cache:  make(map[string]cachedCheck),
+	}
+}
+
+// serviceExists asks the Oracle whether the service is registered, unless an
+// answer is cached. The service is taken to exist for failureTTL when the
+// Oracle fails to answer, which returns the error.
+func (v *serviceValidator) serviceExists(name string) (bool, error) {
+	now := time.Now()
+	v.mu.Lock()
+	check, found := v.cache[name]
+	v.mu.Unlock()
+	if found && now.Before(check.expiresAt) {
+		return check.exists, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeOut)
 	defer cancel()
+	rep, err := v.client.CheckServiceExists(
+		ctx, &pb.CheckServiceExistsReq{ServiceName: name})
+	check = cachedCheck{exists: rep.GetExists(), expiresAt: now.Add(v.ttl)}
+	if err != nil {
+		check = cachedCheck{exists: true, expiresAt: now.Add(failureTTL)}
+	}
+	v.mu.Lock()
+	v.cache[name] = check
+	v.mu.Unlock()
+	return check.exists, err
+}
 
-	return client, ctx
+// unknownServices returns the services that are missing from the Oracle
+// registry. It may block for as long as the Oracle takes to answer.
+func (v *serviceValidator) unknownServices(services []string) (unknown []string) {
+	for _, name := range services {
+		exists, err := v.serviceExists(name)
+		if err != nil {
+			log.Warnf("failed to check service %q with the Oracle, letting it in for %v: %v",
+				name, failureTTL, err)
+		}
+		if !exists {
+			unknown = append(unknown, name)
+		}
+	}
+	return
 }
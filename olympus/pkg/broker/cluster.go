@@ -0,0 +1,514 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+	"google.golang.org/protobuf/proto"
+
+	brokerConfig "github.com/project-auxo/auxo/olympus/internal/config"
+	clusterpb "github.com/project-auxo/auxo/olympus/proto/cluster"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
+)
+
+const notLeaderReason = "not the Olympus leader"
+
+var _notLeaderMsg = &discpb.DiscoveryMessage{
+	Header: discpb.Header_HEADER_DISCONNECT,
+	Origin: &discpb.Entity{Type: entityType},
+	Command: &discpb.DiscoveryMessage_Disconnect{
+		Disconnect: &discpb.Disconnect{Reason: notLeaderReason}},
+}
+
+// cluster connects the broker to the other Olympus instances it is highly
+// available with. Every member publishes heartbeats, and the leader its state,
+// on a PUB socket that the other members subscribe to.
+type cluster struct {
+	id      string
+	pub     *zmq.Socket
+	sub     *zmq.Socket        // Subscribed to every other member
+	members map[string]*member // Keyed by member id, excluding this one
+	leader  string             // Empty when no leader is known
+	term    uint64             // Latest term known, see elect
+	// Sequence number of the last journal change published as the leader, or
+	// mirrored from it.
+	journalSeq uint64
+	syncing    bool // Whether the follower waits for a journal snapshot
+	syncAsked  bool // Whether the leader owes the followers a journal snapshot
+}
+
+type member struct {
+	id      string
+	heardAt time.Time // When the last heartbeat came in
+	leader  string    // Leader according to the last heartbeat
+	term    uint64    // Term according to the last heartbeat
+}
+
+// leads reports whether the member claims to lead the cluster in the term.
+func (m *member) leads(term uint64) bool {
+	return m.leader == m.id && m.term == term
+}
+
+// joinCluster opens the sockets to the other members of the cluster.
+func (broker *Broker) joinCluster(cfg brokerConfig.Cluster) (err error) {
+	c := &cluster{id: cfg.ID, members: make(map[string]*member)}
+	if c.pub, err = zmq.NewSocket(zmq.PUB); err != nil {
+		return
+	}
+	if c.sub, err = zmq.NewSocket(zmq.SUB); err != nil {
+		c.pub.Close()
+		return
+	}
+	if err = broker.secureCluster(c); err != nil {
+		c.close()
+		return
+	}
+	if err = c.pub.Bind(cfg.Endpoint); err != nil {
+		c.close()
+		return fmt.Errorf("cluster endpoint %s: %v", cfg.Endpoint, err)
+	}
+	c.sub.SetSubscribe("")
+	for _, m := range cfg.Members {
+		if err = c.sub.Connect(m.Endpoint); err != nil {
+			c.close()
+			return fmt.Errorf("cluster member %s: %v", m.ID, err)
+		}
+		c.members[m.ID] = &member{id: m.ID}
+	}
+	broker.cluster = c
+	broker.poller.Add(c.sub, zmq.POLLIN)
+	return
+}
+
+// secureCluster makes the members talk over CURVE when the broker uses it.
+// Members share the keypair of the broker, each publishing as a CURVE server
+// the others subscribe to with the same keypair, which is let in along with
+// the allowed keys.
+func (broker *Broker) secureCluster(c *cluster) (err error) {
+	if broker.curve == nil {
+		return
+	}
+	zmq.AuthCurveAdd(broker.curve.domain, broker.curve.public)
+	if err = c.pub.ServerAuthCurve(broker.curve.domain, broker.curve.secret); err != nil {
+		return
+	}
+	return c.sub.ClientAuthCurve(broker.curve.public, broker.curve.public, broker.curve.secret)
+}
+
+func (c *cluster) close() {
+	c.pub.Close()
+	c.sub.Close()
+}
+
+// recvCluster handles the next message from another member.
+func (broker *Broker) recvCluster() (err error) {
+	recvBytes, err := broker.cluster.sub.RecvBytes(0)
+	if err != nil {
+		return
+	}
+	msg := &clusterpb.ClusterMessage{}
+	if err = proto.Unmarshal(recvBytes, msg); err != nil {
+		return
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.handleCluster(msg)
+	return
+}
+
+// The cluster methods below must be called with broker.mu held.
+
+// handleCluster handles a message from another member.
+func (broker *Broker) handleCluster(msg *clusterpb.ClusterMessage) {
+	c := broker.cluster
+	m, found := c.members[msg.GetMember()]
+	if !found {
+		broker.log.Debugf("Ignoring unknown cluster member %q", msg.GetMember())
+		return
+	}
+	switch command := msg.GetCommand().(type) {
+	case *clusterpb.ClusterMessage_Heartbeat:
+		broker.handleClusterHeartbeat(m, command.Heartbeat)
+	case *clusterpb.ClusterMessage_State:
+		if m.id == c.leader && !broker.isLeader() {
+			broker.mirror(command.State)
+		}
+	case *clusterpb.ClusterMessage_Append:
+		entry := command.Append
+		if m.id == c.leader && broker.journal != nil && broker.inSync(entry.GetSequence()) {
+			if err := broker.journal.Append(entry.GetId(), entry.GetData()); err != nil {
+				broker.log.Errorf("failed to mirror journaled request %s: %v", entry.GetId(), err)
+			}
+		}
+	case *clusterpb.ClusterMessage_Done:
+		done := command.Done
+		if m.id == c.leader && broker.journal != nil && broker.inSync(done.GetSequence()) {
+			if err := broker.journal.Done(done.GetId()); err != nil {
+				broker.log.Errorf("failed to mirror completion of request %s: %v",
+					done.GetId(), err)
+			}
+		}
+	case *clusterpb.ClusterMessage_Sync:
+		if broker.isLeader() {
+			c.syncAsked = true
+		}
+	case *clusterpb.ClusterMessage_Snapshot:
+		if m.id == c.leader && !broker.isLeader() {
+			broker.mirrorJournal(command.Snapshot)
+		}
+	}
+}
+
+// handleClusterHeartbeat records a heartbeat of another member. A leader
+// hearing of a later term than its own steps down, as another member took
+// over since.
+func (broker *Broker) handleClusterHeartbeat(m *member, heartbeat *clusterpb.Heartbeat) {
+	c := broker.cluster
+	if m.heardAt.IsZero() || time.Since(m.heardAt) > heartbeatExpiry {
+		broker.log.Infof("Cluster member %s is up", m.id)
+	}
+	m.heardAt = time.Now()
+	m.leader, m.term = heartbeat.GetLeader(), heartbeat.GetTerm()
+	if m.term <= c.term {
+		return
+	}
+	c.term = m.term
+	if broker.isLeader() {
+		broker.log.Warnf("Cluster member %s is in the later term %d", m.id, m.term)
+		broker.setLeader("")
+	}
+}
+
+// isLeader reports whether the broker serves agents and clients, which a
+// broker outside of a cluster always does.
+func (broker *Broker) isLeader() bool {
+	return broker.cluster == nil || broker.cluster.leader == broker.cluster.id
+}
+
+// turnAway answers the agents and clients of a broker that doesn't lead, so
+// that agents fail over to another member.
+func (broker *Broker) turnAway(identity string, msg *discpb.DiscoveryMessage) {
+	switch msg.GetHeader() {
+	case discpb.Header_HEADER_READY, discpb.Header_HEADER_HEARTBEAT:
+		broker.send(identity, _notLeaderMsg)
+	case discpb.Header_HEADER_REQUEST:
+		req := msg.GetRequest()
+		broker.sendError(identity, req, req.GetId(), discpb.Error_UNAVAILABLE, notLeaderReason)
+	}
+}
+
+// publishCluster sends a message to the other members.
+func (broker *Broker) publishCluster(msg *clusterpb.ClusterMessage) {
+	msg.Member = broker.cluster.id
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		broker.log.Warnf("failed to marshal cluster message: %v", err)
+		return
+	}
+	if _, err := broker.cluster.pub.SendBytes(msgBytes, zmq.DONTWAIT); err != nil {
+		broker.log.Debugf("failed to publish to the cluster: %v", err)
+	}
+}
+
+// clusterTick runs on every heartbeat: it elects the leader among the live
+// members and publishes the heartbeat of this member, as well as the state
+// when it leads.
+func (broker *Broker) clusterTick() {
+	if broker.cluster == nil {
+		return
+	}
+	broker.elect()
+	broker.publishCluster(&clusterpb.ClusterMessage{
+		Command: &clusterpb.ClusterMessage_Heartbeat{Heartbeat: &clusterpb.Heartbeat{
+			Leader: broker.cluster.leader,
+			Term:   broker.cluster.term,
+		}},
+	})
+	if !broker.isLeader() {
+		return
+	}
+	broker.publishCluster(&clusterpb.ClusterMessage{
+		Command: &clusterpb.ClusterMessage_State{State: broker.state()},
+	})
+	if broker.cluster.syncAsked {
+		broker.cluster.syncAsked = false
+		broker.publishCluster(&clusterpb.ClusterMessage{
+			Command: &clusterpb.ClusterMessage_Snapshot{Snapshot: broker.snapshot()},
+		})
+	}
+}
+
+// elect settles who leads the cluster, provided a majority of the cluster is
+// live, so that a partitioned minority never leads. The leader is the live
+// member claiming the lead in the latest term, the one with the lowest id
+// should several claim it. When none does, the live member with the lowest id
+// takes over in a new term, unless another member follows a leader in the
+// latest term that this one can't hear. As a leader steps down on hearing of
+// a later term, two members never lead for longer than it takes their
+// heartbeats to get around, even when some members can't hear each other.
+func (broker *Broker) elect() {
+	c := broker.cluster
+	live := 1
+	lowest := c.id // Lowest live id
+	leader := ""
+	if broker.isLeader() {
+		leader = c.id
+	}
+	followed := false // Whether a member follows another leader in the term
+	for _, m := range c.members {
+		if time.Since(m.heardAt) > heartbeatExpiry {
+			continue
+		}
+		live++
+		if m.id < lowest {
+			lowest = m.id
+		}
+		if m.leads(c.term) && (leader == "" || m.id < leader) {
+			leader = m.id
+		}
+		if m.term == c.term && m.leader != "" && m.leader != c.id {
+			followed = true
+		}
+	}
+	switch {
+	case 2*live <= len(c.members)+1:
+		leader = ""
+	case leader == "" && lowest == c.id && !followed:
+		c.term++
+		leader = c.id
+	}
+	broker.setLeader(leader)
+}
+
+// setLeader records the leader, taking over or handing over the agents as
+// this broker becomes or stops being the leader.
+func (broker *Broker) setLeader(leader string) {
+	c := broker.cluster
+	if leader == c.leader {
+		return
+	}
+	wasLeader := broker.isLeader()
+	c.leader = leader
+	switch {
+	case leader == "":
+		broker.log.Warnf("No cluster leader in term %d", c.term)
+	case broker.isLeader():
+		broker.log.Infof("Leading the cluster as %s in term %d", c.id, c.term)
+	default:
+		broker.log.Infof("Following cluster leader %s in term %d", leader, c.term)
+	}
+	if broker.isLeader() && !wasLeader {
+		broker.promote()
+	} else if wasLeader && !broker.isLeader() {
+		broker.demote()
+	}
+}
+
+// promote takes over from the previous leader, whose agents reconnect to this
+// broker. The agents mirrored from the previous leader are dropped until they
+// do, and the durable requests it had not replied to are queued again.
+func (broker *Broker) promote() {
+	broker.agents = make(map[string]*agent)
+	broker.cluster.syncing = false
+	if broker.journal != nil {
+		broker.replayJournal()
+	}
+}
+
+// demote sends the agents to the new leader and fails the queued and
+// dispatched requests. The durable ones are kept in the journal, for whichever
+// member leads next.
+func (broker *Broker) demote() {
+	for identity, a := range broker.agents {
+		broker.publish(pb.AgentEvent_DISCONNECTED, a)
+		broker.leaveServices(a)
+		broker.send(identity, _notLeaderMsg)
+		for id, req := range a.inFlight {
+			delete(a.inFlight, id)
+			switch {
+			case req.broadcast != nil:
+				broker.gatherFailure(req, a, discpb.Error_UNAVAILABLE, notLeaderReason)
+			case !req.msg.GetDurable() || broker.journal == nil:
+				broker.sendError(req.client, req.msg, req.clientID, discpb.Error_UNAVAILABLE,
+					notLeaderReason)
+			}
+		}
+	}
+	broker.agents = make(map[string]*agent)
+	for _, srv := range broker.services {
+		for _, req := range srv.requests {
+			if req.msg.GetDurable() && broker.journal != nil {
+				continue
+			}
+			broker.sendError(req.client, req.msg, req.clientID, discpb.Error_UNAVAILABLE,
+				notLeaderReason)
+		}
+		srv.requests = nil
+		srv.waiting = nil
+	}
+}
+
+// state is what the followers mirror of the leader, with only a digest of the
+// journal.
+func (broker *Broker) state() *clusterpb.State {
+	state := &clusterpb.State{
+		RequestId:       broker.nextRequestID,
+		JournalSequence: broker.cluster.journalSeq,
+		JournalDigest:   broker.journalDigest(),
+	}
+	for _, a := range broker.agents {
+		state.Agents = append(state.Agents, agentInfo(a))
+	}
+	return state
+}
+
+// journalDigest sums up the pending entries of the journal, see
+// clusterpb.State.
+func (broker *Broker) journalDigest() []byte {
+	var ids []string
+	if broker.journal != nil {
+		for _, entry := range broker.journal.Pending() {
+			ids = append(ids, entry.ID)
+		}
+	}
+	sort.Strings(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write([]byte(id + "\n"))
+	}
+	return h.Sum(nil)
+}
+
+// snapshot is the whole journal, for the followers that fell out of sync.
+func (broker *Broker) snapshot() *clusterpb.JournalSnapshot {
+	snapshot := &clusterpb.JournalSnapshot{Sequence: broker.cluster.journalSeq}
+	if broker.journal != nil {
+		for _, entry := range broker.journal.Pending() {
+			snapshot.Entries = append(snapshot.Entries,
+				&clusterpb.JournalEntry{Id: entry.ID, Data: entry.Data})
+		}
+	}
+	return snapshot
+}
+
+// mirror brings the follower up to date with the leader's state. Mirrored
+// agents are only listed by the frontend, they are never dispatched to.
+func (broker *Broker) mirror(state *clusterpb.State) {
+	if state.GetRequestId() > broker.nextRequestID {
+		broker.nextRequestID = state.GetRequestId()
+	}
+	agents := make(map[string]*agent)
+	for _, info := range state.GetAgents() {
+		identity, err := hex.DecodeString(info.GetIdentity())
+		if err != nil {
+			continue
+		}
+		agents[string(identity)] = &agent{
+			identity:        string(identity),
+			name:            info.GetName(),
+			services:        info.GetServices(),
+			protocolVersion: info.GetProtocolVersion(),
+			labels:          info.GetLabels(),
+			maxConcurrency:  int(info.GetMaxConcurrency()),
+			connectedAt:     info.GetConnectTime().AsTime(),
+			lastHeartbeat:   time.Now(),
+			inFlight:        make(map[string]*request),
+			state:           info.GetState(),
+			features:        make(map[string]bool),
+		}
+		for _, feature := range info.GetFeatures() {
+			agents[string(identity)].features[feature] = true
+		}
+	}
+	broker.agents = agents
+
+	// Changes to the journal may have been missed, or mirrored from a previous
+	// leader.
+	if broker.journal != nil && (state.GetJournalSequence() != broker.cluster.journalSeq ||
+		!bytes.Equal(state.GetJournalDigest(), broker.journalDigest())) {
+		broker.askSync()
+	}
+}
+
+// inSync reports whether the journal change of the given sequence number
+// follows the last one mirrored, recording it if so. Otherwise some were
+// missed, and the follower asks for a snapshot.
+func (broker *Broker) inSync(sequence uint64) bool {
+	c := broker.cluster
+	if c.syncing {
+		return false
+	}
+	if sequence != c.journalSeq+1 {
+		broker.log.Warnf("Missed journal changes %d to %d", c.journalSeq+1, sequence-1)
+		broker.askSync()
+		return false
+	}
+	c.journalSeq = sequence
+	return true
+}
+
+// askSync asks the leader for a snapshot of its journal, until one comes.
+func (broker *Broker) askSync() {
+	broker.cluster.syncing = true
+	broker.publishCluster(&clusterpb.ClusterMessage{
+		Command: &clusterpb.ClusterMessage_Sync{Sync: &clusterpb.SyncRequest{}},
+	})
+}
+
+// mirrorJournal brings the journal of the follower in line with the snapshot
+// of the leader's.
+func (broker *Broker) mirrorJournal(snapshot *clusterpb.JournalSnapshot) {
+	c := broker.cluster
+	c.journalSeq, c.syncing = snapshot.GetSequence(), false
+	if broker.journal == nil {
+		return
+	}
+	leading := make(map[string]bool)
+	for _, entry := range snapshot.GetEntries() {
+		leading[entry.GetId()] = true
+	}
+	for _, entry := range broker.journal.Pending() {
+		if !leading[entry.ID] {
+			broker.journal.Done(entry.ID)
+		}
+		delete(leading, entry.ID)
+	}
+	for _, entry := range snapshot.GetEntries() {
+		if leading[entry.GetId()] {
+			if err := broker.journal.Append(entry.GetId(), entry.GetData()); err != nil {
+				broker.log.Errorf("failed to mirror journaled request %s: %v", entry.GetId(), err)
+			}
+		}
+	}
+}
+
+// replicateAppend passes a journaled request on to the followers.
+func (broker *Broker) replicateAppend(id string, data []byte) {
+	if broker.cluster == nil {
+		return
+	}
+	broker.cluster.journalSeq++
+	broker.publishCluster(&clusterpb.ClusterMessage{
+		Command: &clusterpb.ClusterMessage_Append{Append: &clusterpb.JournalEntry{
+			Id: id, Data: data, Sequence: broker.cluster.journalSeq}},
+	})
+}
+
+// replicateDone passes the completion of a journaled request on to the
+// followers.
+func (broker *Broker) replicateDone(id string) {
+	if broker.cluster == nil {
+		return
+	}
+	broker.cluster.journalSeq++
+	broker.publishCluster(&clusterpb.ClusterMessage{
+		Command: &clusterpb.ClusterMessage_Done{Done: &clusterpb.JournalDone{
+			Id: id, Sequence: broker.cluster.journalSeq}},
+	})
+}
@@ -0,0 +1,295 @@
+package broker
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+
+	brokerConfig "github.com/project-auxo/auxo/olympus/internal/config"
+	"github.com/project-auxo/auxo/olympus/logging"
+	"github.com/project-auxo/auxo/olympus/pkg/journal"
+	clusterpb "github.com/project-auxo/auxo/olympus/proto/cluster"
+)
+
+const clusterTestPort = 25570
+
+// memberConfig configures the member of a cluster made of the given ids,
+// numbered from 0, which publish on consecutive ports from the given one.
+func memberConfig(ids []string, i, port int) *brokerConfig.Config {
+	cfg := &brokerConfig.Config{}
+	cfg.Broker.Name = ids[i]
+	cfg.Broker.Cluster.ID = ids[i]
+	cfg.Broker.Cluster.Endpoint = fmt.Sprintf("tcp://*:%d", port+i)
+	for j, id := range ids {
+		if j != i {
+			cfg.Broker.Cluster.Members = append(cfg.Broker.Cluster.Members, brokerConfig.Member{
+				ID:       id,
+				Endpoint: fmt.Sprintf("tcp://localhost:%d", port+j),
+			})
+		}
+	}
+	return cfg
+}
+
+// startMember runs a member of a cluster on its broker loop.
+func startMember(t *testing.T, cfg *brokerConfig.Config) *Broker {
+	t.Helper()
+	broker, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New(%s): %v", cfg.Broker.Cluster.ID, err)
+	}
+	go broker.handle()
+	return broker
+}
+
+// stopBroker kills the broker, which goes silent without handing over.
+func stopBroker(broker *Broker) {
+	broker.do(func() { broker.quit = true })
+	<-broker.stopped
+	broker.close()
+}
+
+// leaderOf returns the leader according to the member, and the term.
+func leaderOf(broker *Broker) (leader string, term uint64) {
+	broker.do(func() { leader, term = broker.cluster.leader, broker.cluster.term })
+	return
+}
+
+// waitForLeader waits until every member follows the same leader, other than
+// the gone one, which it returns along with its term.
+func waitForLeader(
+	t *testing.T, members []*Broker, gone string, timeout time.Duration) (string, uint64) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		leader, term := leaderOf(members[0])
+		agreed := leader != "" && leader != gone
+		for _, broker := range members[1:] {
+			if l, tm := leaderOf(broker); l != leader || tm != term {
+				agreed = false
+			}
+		}
+		if agreed {
+			return leader, term
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, broker := range members {
+		leader, term := leaderOf(broker)
+		t.Logf("%s follows %q in term %d", broker.cluster.id, leader, term)
+	}
+	t.Fatalf("no leader agreed on within %v", timeout)
+	return "", 0
+}
+
+func TestClusterFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for heartbeats to expire")
+	}
+	ids := []string{"olympus-1", "olympus-2", "olympus-3"}
+	var members []*Broker
+	for i := range ids {
+		members = append(members, startMember(t, memberConfig(ids, i, clusterTestPort)))
+	}
+	defer func() {
+		for _, broker := range members[1:] {
+			stopBroker(broker)
+		}
+	}()
+
+	timeout := 4 * heartbeatExpiry
+	leader, term := waitForLeader(t, members, "", timeout)
+	if leader != ids[0] {
+		t.Fatalf("%s leads, want %s", leader, ids[0])
+	}
+
+	stopBroker(members[0])
+	newLeader, newTerm := waitForLeader(t, members[1:], ids[0], timeout)
+	if newLeader != ids[1] {
+		t.Errorf("%s took over, want %s", newLeader, ids[1])
+	}
+	if newTerm <= term {
+		t.Errorf("%s took over in term %d, want a term after %d", newLeader, newTerm, term)
+	}
+	leaders := 0
+	for _, broker := range members[1:] {
+		broker.do(func() {
+			if broker.isLeader() {
+				leaders++
+			}
+		})
+	}
+	if leaders != 1 {
+		t.Errorf("%d members lead, want 1", leaders)
+	}
+}
+
+func TestClusterOverCurve(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for heartbeats to expire")
+	}
+	// The first two members share a keypair, the last one doesn't.
+	ids := []string{"olympus-1", "olympus-2", "olympus-3"}
+	shared, other := writeCurve(t), writeCurve(t)
+	var members []*Broker
+	for i := range ids {
+		cfg := memberConfig(ids, i, clusterTestPort+len(ids))
+		cfg.Broker.Curve = shared
+		if i == 2 {
+			cfg.Broker.Curve = other
+		}
+		members = append(members, startMember(t, cfg))
+	}
+	defer func() {
+		for _, broker := range members {
+			stopBroker(broker)
+		}
+	}()
+
+	if leader, _ := waitForLeader(t, members[:2], "", 4*heartbeatExpiry); leader != ids[0] {
+		t.Errorf("%s leads, want %s", leader, ids[0])
+	}
+	if leader, _ := leaderOf(members[2]); leader != "" {
+		t.Errorf("%s follows %s without the keypair of the cluster", ids[2], leader)
+	}
+}
+
+// newTestMember returns a member that hears from the others as set up by the
+// test, without any sockets.
+func newTestMember(id string, others ...string) *Broker {
+	broker := &Broker{
+		log:      logging.Base(),
+		agents:   make(map[string]*agent),
+		services: make(map[string]*service),
+		cluster:  &cluster{id: id, members: make(map[string]*member)},
+	}
+	for _, other := range others {
+		broker.cluster.members[other] = &member{id: other}
+	}
+	return broker
+}
+
+func TestLeaderStepsDownOnLaterTerm(t *testing.T) {
+	// a can't hear b, which can hear a and c.
+	a := newTestMember("a", "b", "c")
+	b := newTestMember("b", "a", "c")
+	hear := func(broker *Broker, from *Broker) {
+		broker.handleClusterHeartbeat(broker.cluster.members[from.cluster.id],
+			&clusterpb.Heartbeat{Leader: from.cluster.leader, Term: from.cluster.term})
+	}
+	c := newTestMember("c", "a", "b")
+	hear(a, c)
+	a.elect()
+	if !a.isLeader() || a.cluster.term != 1 {
+		t.Fatalf("a follows %q in term %d, want to lead in term 1", a.cluster.leader, a.cluster.term)
+	}
+
+	// b stops hearing a, and takes over in a later term.
+	hear(b, c)
+	b.cluster.term = a.cluster.term
+	b.elect()
+	if !b.isLeader() || b.cluster.term != 2 {
+		t.Fatalf("b follows %q in term %d, want to lead in term 2", b.cluster.leader, b.cluster.term)
+	}
+
+	// c follows b, and a hears of the later term from c.
+	hear(c, b)
+	c.elect()
+	if c.cluster.leader != "b" {
+		t.Fatalf("c follows %q, want b", c.cluster.leader)
+	}
+	hear(a, c)
+	if a.isLeader() {
+		t.Fatalf("a still leads after hearing of term %d", c.cluster.term)
+	}
+	a.elect()
+	if a.isLeader() {
+		t.Errorf("a took the lead back in term %d while b leads", a.cluster.term)
+	}
+}
+
+func TestLowestIDWinsConflictingClaims(t *testing.T) {
+	b := newTestMember("b", "a", "c")
+	b.cluster.term = 3
+	b.cluster.leader = "b"
+	now := time.Now()
+	b.cluster.members["a"].heardAt = now
+	b.cluster.members["a"].leader, b.cluster.members["a"].term = "a", 3
+	b.cluster.members["c"].heardAt = now
+	b.elect()
+	if b.cluster.leader != "a" {
+		t.Errorf("b follows %q, want a, which claims the same term", b.cluster.leader)
+	}
+}
+
+// pendingIDs lists the entries of the journal not done yet.
+func pendingIDs(j *journal.Journal) (ids []string) {
+	for _, entry := range j.Pending() {
+		ids = append(ids, entry.ID)
+	}
+	return
+}
+
+func TestFollowerResyncsMissedJournalChanges(t *testing.T) {
+	b := newTestMember("b", "a")
+	b.cluster.leader = "a"
+	var err error
+	if b.journal, err = journal.Open(filepath.Join(t.TempDir(), "journal")); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.journal.Close()
+	// Asking for a snapshot goes nowhere.
+	if b.cluster.pub, err = zmq.NewSocket(zmq.PUB); err != nil {
+		t.Fatalf("NewSocket: %v", err)
+	}
+	defer b.cluster.pub.Close()
+	fromA := func(msg *clusterpb.ClusterMessage) {
+		msg.Member = "a"
+		b.handleCluster(msg)
+	}
+	appended := func(id string, sequence uint64) *clusterpb.ClusterMessage {
+		return &clusterpb.ClusterMessage{Command: &clusterpb.ClusterMessage_Append{
+			Append: &clusterpb.JournalEntry{Id: id, Data: []byte(id), Sequence: sequence}}}
+	}
+
+	fromA(appended("1", 1))
+	fromA(appended("2", 2))
+	fromA(&clusterpb.ClusterMessage{Command: &clusterpb.ClusterMessage_Done{
+		Done: &clusterpb.JournalDone{Id: "1", Sequence: 3}}})
+	fromA(&clusterpb.ClusterMessage{Command: &clusterpb.ClusterMessage_State{
+		State: &clusterpb.State{JournalSequence: 3, JournalDigest: b.journalDigest()}}})
+	if b.cluster.syncing {
+		t.Fatal("b asked for a snapshot while in sync")
+	}
+	if ids, want := pendingIDs(b.journal), []string{"2"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("b mirrored %v, want %v", ids, want)
+	}
+
+	// Change 4 is lost, b waits for a snapshot from then on.
+	fromA(appended("4", 5))
+	if !b.cluster.syncing {
+		t.Fatal("b didn't ask for a snapshot after missing a change")
+	}
+	fromA(appended("5", 6))
+	fromA(&clusterpb.ClusterMessage{Command: &clusterpb.ClusterMessage_Snapshot{
+		Snapshot: &clusterpb.JournalSnapshot{Sequence: 6, Entries: []*clusterpb.JournalEntry{
+			{Id: "3", Data: []byte("3")}, {Id: "4", Data: []byte("4")},
+			{Id: "5", Data: []byte("5")}}}}})
+	if b.cluster.syncing || b.cluster.journalSeq != 6 {
+		t.Fatalf("b is at change %d after the snapshot, want 6", b.cluster.journalSeq)
+	}
+	if ids, want := pendingIDs(b.journal), []string{"3", "4", "5"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("b mirrored %v, want %v", ids, want)
+	}
+
+	// A digest that differs at the same change also calls for a snapshot.
+	fromA(&clusterpb.ClusterMessage{Command: &clusterpb.ClusterMessage_State{
+		State: &clusterpb.State{JournalSequence: 6, JournalDigest: []byte("other")}}})
+	if !b.cluster.syncing {
+		t.Error("b didn't ask for a snapshot of a journal that differs")
+	}
+}
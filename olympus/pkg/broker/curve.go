@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+
+	zmq "github.com/pebbe/zmq4"
+
+	brokerConfig "github.com/project-auxo/auxo/olympus/internal/config"
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+)
+
+// ZAP domain of the broker sockets, numbered by brokerCount so that brokers
+// sharing the process keep their allowed keys apart.
+const curveDomain = "olympus-%d"
+
+// curveKeypair is the keypair of a broker using CURVE, which it also presents
+// to its peers.
+type curveKeypair struct {
+	public string
+	secret string
+	domain string // ZAP domain allowing the keys the broker lets in
+}
+
+// The ZAP handler serves the whole process, it runs while any broker uses
+// CURVE.
+var zap struct {
+	sync.Mutex
+	users int
+}
+
+func startZAP() (err error) {
+	zap.Lock()
+	defer zap.Unlock()
+	if zap.users == 0 {
+		if err = zmq.AuthStart(); err != nil {
+			return
+		}
+	}
+	zap.users++
+	return
+}
+
+func stopZAP() {
+	zap.Lock()
+	defer zap.Unlock()
+	if zap.users--; zap.users == 0 {
+		zmq.AuthStop()
+	}
+}
+
+// setupCurve makes the ROUTER socket a CURVE server in the ZAP domain, which
+// only lets in the allowed keys.
+func (broker *Broker) setupCurve(cfg brokerConfig.Curve, domain string) (err error) {
+	if cfg.AllowedKeysFile == "" {
+		return errors.New("curve: allowed_keys_file is required")
+	}
+	public, secret, err := util.CurveKeypair(cfg.SecretKeyFile)
+	if err != nil {
+		return
+	}
+	allowed, err := util.ReadCurveKeys(cfg.AllowedKeysFile)
+	if err != nil {
+		return
+	}
+	if err = startZAP(); err != nil {
+		return
+	}
+	zmq.AuthCurveAdd(domain, allowed...)
+	if err = broker.socket.ServerAuthCurve(domain, secret); err != nil {
+		zmq.AuthCurveRemoveAll(domain)
+		stopZAP()
+		return
+	}
+	broker.curve = &curveKeypair{public: public, secret: secret, domain: domain}
+	broker.log.Infof("CURVE enabled, allowing %d key(s)", len(allowed))
+	return
+}
+
+// close stops letting in the keys of the broker.
+func (k *curveKeypair) close() {
+	zmq.AuthCurveRemoveAll(k.domain)
+	stopZAP()
+}
@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+
+	brokerConfig "github.com/project-auxo/auxo/olympus/internal/config"
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+)
+
+const curveTestPort = 25600
+
+// writeCurve writes a new secret key and the allow-list, returning the CURVE
+// configuration using them.
+func writeCurve(t *testing.T, allowed ...string) brokerConfig.Curve {
+	t.Helper()
+	dir := t.TempDir()
+	if _, err := util.WriteCurveKeypair(filepath.Join(dir, "olympus")); err != nil {
+		t.Fatalf("WriteCurveKeypair: %v", err)
+	}
+	allowedFile := filepath.Join(dir, "allowed_keys")
+	if err := ioutil.WriteFile(allowedFile, []byte(strings.Join(allowed, "\n")), 0644); err != nil {
+		t.Fatalf("write allowed keys: %v", err)
+	}
+	return brokerConfig.Curve{
+		SecretKeyFile:   filepath.Join(dir, "olympus.key_secret"),
+		AllowedKeysFile: allowedFile,
+	}
+}
+
+// startCurveBroker runs a broker using CURVE on the port, returning its public
+// key.
+func startCurveBroker(t *testing.T, port int, curve brokerConfig.Curve) (*Broker, string) {
+	t.Helper()
+	cfg := &brokerConfig.Config{}
+	cfg.Broker.Curve = curve
+	broker, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	broker.bind(fmt.Sprintf("tcp://*:%d", port))
+	go broker.handle()
+	public, _, err := util.CurveKeypair(curve.SecretKeyFile)
+	if err != nil {
+		t.Fatalf("CurveKeypair: %v", err)
+	}
+	return broker, public
+}
+
+// letsIn reports whether an agent with the keypair gets registered by the
+// broker.
+func letsIn(t *testing.T, broker *Broker, port int, serverKey, public, secret string) bool {
+	t.Helper()
+	socket, err := zmq.NewSocket(zmq.DEALER)
+	if err != nil {
+		t.Fatalf("NewSocket: %v", err)
+	}
+	defer socket.Close()
+	if err = socket.ClientAuthCurve(serverKey, public, secret); err != nil {
+		t.Fatalf("ClientAuthCurve: %v", err)
+	}
+	if err = socket.Connect(fmt.Sprintf("tcp://localhost:%d", port)); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	sendReady(t, socket, util.ProtocolVersion)
+	time.Sleep(200 * time.Millisecond)
+	registered := false
+	broker.do(func() {
+		registered = len(broker.agents) > 0
+		broker.agents = make(map[string]*agent)
+	})
+	return registered
+}
+
+func TestCurveBrokersKeepTheirKeys(t *testing.T) {
+	alice, aliceSecret, _ := zmq.NewCurveKeypair()
+	bob, bobSecret, _ := zmq.NewCurveKeypair()
+	first, _ := startCurveBroker(t, curveTestPort, writeCurve(t, alice))
+	second, secondKey := startCurveBroker(t, curveTestPort+1, writeCurve(t, bob))
+	defer stopBroker(second)
+
+	if !letsIn(t, second, curveTestPort+1, secondKey, bob, bobSecret) {
+		t.Fatal("an allowed key was turned away")
+	}
+	if letsIn(t, second, curveTestPort+1, secondKey, alice, aliceSecret) {
+		t.Error("a key allowed by another broker was let in")
+	}
+	// The other broker going away leaves the ZAP handler running.
+	stopBroker(first)
+	if letsIn(t, second, curveTestPort+1, secondKey, alice, aliceSecret) {
+		t.Error("a key that isn't allowed was let in once another broker stopped")
+	}
+}
@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+const (
+	// Dead letters kept before the oldest ones are dropped.
+	maxDeadLetters = 1000
+	// Correlation ID of a replayed request, from that of the original and the
+	// new request ID.
+	replayCorrelationID = "%s/replay-%s"
+)
+
+// deadLetter is a request that ran out of retries.
+type deadLetter struct {
+	req    *request
+	reason string // Why the last attempt failed
+	time   time.Time
+}
+
+// The dead-letter methods below must be called with broker.mu held.
+
+func (broker *Broker) deadLetter(req *request, reason string) {
+	broker.deadLetters = append(
+		broker.deadLetters, &deadLetter{req: req, reason: reason, time: time.Now()})
+	if overflow := len(broker.deadLetters) - maxDeadLetters; overflow > 0 {
+		broker.log.Warnf("dead-letter queue full, dropping %d request(s)", overflow)
+		broker.deadLetters = broker.deadLetters[overflow:]
+	}
+}
+
+// replayDeadLetter queues the dead-lettered request again with a fresh retry
+// budget, returning nil if there is no such request. Its client was already
+// told it failed, so it is replayed as a new request, with a new ID and
+// correlation ID, for the client to get a single reply to the original.
+func (broker *Broker) replayDeadLetter(id string) *request {
+	for i, letter := range broker.deadLetters {
+		if letter.req.id != id {
+			continue
+		}
+		broker.deadLetters = append(broker.deadLetters[:i], broker.deadLetters[i+1:]...)
+		req := letter.req
+		broker.nextRequestID++
+		req.id = strconv.FormatUint(broker.nextRequestID, 10)
+		req.clientID = req.id
+		req.msg = proto.Clone(req.msg).(*discpb.Request)
+		req.msg.CorrelationId = fmt.Sprintf(replayCorrelationID, req.msg.GetCorrelationId(), req.id)
+		req.attempts = 0
+		req.tried = make(map[string]bool)
+		req.expiresAt = time.Now().Add(broker.requestTimeout)
+		if req.msg.GetDurable() && broker.journal != nil {
+			if err := broker.journalRequest(req); err != nil {
+				broker.log.Errorf("failed to journal replayed request %s: %v", id, err)
+			}
+		}
+		broker.enqueue(req)
+		return req
+	}
+	return nil
+}
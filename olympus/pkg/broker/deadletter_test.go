@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+const deadLetterTestPort = 25605
+
+func TestReplayedDeadLetterIsRepliedToOnce(t *testing.T) {
+	broker := startBroker(t, deadLetterTestPort)
+	defer stopBroker(broker)
+	agent := connectAgent(t, deadLetterTestPort)
+	defer agent.Close()
+	sendReady(t, agent, util.ProtocolVersion)
+	recvWithin(t, agent, time.Second)
+	client := connectAgent(t, deadLetterTestPort)
+	defer client.Close()
+	sendMsg(t, client, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REQUEST,
+		Origin: &discpb.Entity{Type: discpb.Entity_CLIENT},
+		Command: &discpb.DiscoveryMessage_Request{Request: &discpb.Request{
+			ServiceName:   "echo",
+			CorrelationId: "1",
+		}},
+	})
+	msg, _ := recvWithin(t, agent, time.Second)
+	id := msg.GetRequest().GetId()
+
+	// The agent leaves without replying, and the request runs out of retries.
+	sendMsg(t, agent, &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_DISCONNECT,
+		Origin:  &discpb.Entity{Type: discpb.Entity_AGENT},
+		Command: &discpb.DiscoveryMessage_Disconnect{Disconnect: &discpb.Disconnect{}},
+	})
+	msg, _ = recvWithin(t, client, time.Second)
+	if reply := msg.GetReply(); reply.GetCorrelationId() != "1" ||
+		reply.GetError().GetCode() != discpb.Error_RETRIES_EXHAUSTED {
+		t.Fatalf("client got %v, want request 1 to run out of retries", msg)
+	}
+
+	replacement := connectAgent(t, deadLetterTestPort)
+	defer replacement.Close()
+	sendReady(t, replacement, util.ProtocolVersion)
+	recvWithin(t, replacement, time.Second)
+	var replayed *request
+	broker.do(func() { replayed = broker.replayDeadLetter(id) })
+	if replayed == nil {
+		t.Fatalf("no dead letter %s", id)
+	}
+	msg, _ = recvWithin(t, replacement, time.Second)
+	sendMsg(t, replacement, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REPLY,
+		Origin: &discpb.Entity{Type: discpb.Entity_AGENT},
+		Command: &discpb.DiscoveryMessage_Reply{Reply: &discpb.Reply{
+			Id: msg.GetRequest().GetId(),
+		}},
+	})
+	msg, _ = recvWithin(t, client, time.Second)
+	want := fmt.Sprintf(replayCorrelationID, "1", replayed.id)
+	if reply := msg.GetReply(); reply.GetCorrelationId() != want || reply.GetError() != nil {
+		t.Fatalf("client got %v, want the reply to the replay, correlated by %q", msg, want)
+	}
+	if msg, _ := recvWithin(t, client, 2*heartbeatInterval); msg != nil {
+		t.Errorf("client got %v after both replies", msg)
+	}
+}
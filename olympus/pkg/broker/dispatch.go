@@ -0,0 +1,472 @@
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
+)
+
+// service is a Majordomo-style queue of pending requests and idle agents for
+// a single service name.
+type service struct {
+	name     string
+	requests []*request // Pending requests, highest priority then oldest first
+	waiting  []*agent   // Agents with spare capacity, longest waiting first
+	balancer balancer
+	stats    serviceStats
+}
+
+// request is a client request routed through the broker.
+type request struct {
+	id        string
+	clientID  string // Id the client knows the request by, echoed in the reply
+	client    string // Routing identity of the requesting client
+	msg       *discpb.Request
+	selector  labelSelector
+	queuedAt  time.Time       // When the request was queued, to age its priority
+	expiresAt time.Time       // When to give up waiting for a matching agent
+	deadline  time.Time       // When to give up waiting for the reply
+	attempts  int             // Number of times the request was dispatched
+	tried     map[string]bool // Identities of the agents it was dispatched to
+	broadcast *broadcast      // Nil unless sent to every matching agent
+	stream    *stream         // Nil unless the reply is streamed
+}
+
+// The dispatch methods below must be called with broker.mu held.
+
+// getService returns the named service, creating it if needed.
+func (broker *Broker) getService(name string) *service {
+	srv, found := broker.services[name]
+	if !found {
+		// The balancer names were validated by New.
+		b, _ := newBalancer(broker.serviceCfgs[name].Balancer)
+		srv = &service{name: name, balancer: b}
+		broker.services[name] = srv
+	}
+	return srv
+}
+
+// offerAgent puts an agent with spare capacity on the waiting list of every
+// service it offers and dispatches any requests queued for them. Draining
+// agents are released instead, once done.
+func (broker *Broker) offerAgent(a *agent) {
+	if a.state == pb.Agent_DRAINING {
+		broker.releaseDrained(a)
+		return
+	}
+	if broker.draining || a.state != pb.Agent_ACTIVE {
+		return
+	}
+	broker.waitAgent(a)
+	for _, name := range a.services {
+		broker.dispatch(broker.services[name])
+	}
+}
+
+// waitAgent appends the agent to the waiting lists, if it has spare capacity
+// and isn't waiting already.
+func (broker *Broker) waitAgent(a *agent) {
+	if !a.hasCapacity() {
+		return
+	}
+	for _, name := range a.services {
+		srv := broker.getService(name)
+		waiting := false
+		for _, w := range srv.waiting {
+			if w == a {
+				waiting = true
+				break
+			}
+		}
+		if !waiting {
+			srv.waiting = append(srv.waiting, a)
+		}
+	}
+}
+
+// withdrawAgent takes the agent off every waiting list.
+func (broker *Broker) withdrawAgent(a *agent) {
+	for _, name := range a.services {
+		srv, found := broker.services[name]
+		if !found {
+			continue
+		}
+		for i, waiting := range srv.waiting {
+			if waiting == a {
+				srv.waiting = append(srv.waiting[:i], srv.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// enqueue queues a new client request on its service, behind the requests of
+// the same or higher priority.
+func (broker *Broker) enqueue(req *request) {
+	srv := broker.getService(req.msg.GetServiceName())
+	req.queuedAt = time.Now()
+	srv.requests = append(srv.requests, req)
+	broker.prioritize(srv)
+	broker.dispatch(srv)
+}
+
+// retry puts a request whose attempt failed back at the front of its service
+// queue, or moves it to the dead-letter queue once it used up its retries.
+func (broker *Broker) retry(req *request, reason string) {
+	srvCfg := broker.serviceCfgs[req.msg.GetServiceName()]
+	if req.attempts > srvCfg.Retries {
+		broker.log.Warnf("Dead-lettering request %s after %d attempt(s): %s",
+			req.id, req.attempts, reason)
+		broker.deadLetter(req, reason)
+		broker.completeRequest(req)
+		broker.sendError(req.client, req.msg, req.clientID, discpb.Error_RETRIES_EXHAUSTED,
+			fmt.Sprintf("gave up after %d attempt(s): %s", req.attempts, reason))
+		return
+	}
+	broker.log.Infof("Retrying request %s: %s", req.id, reason)
+	req.expiresAt = time.Now().Add(broker.requestTimeout)
+	srv := broker.getService(req.msg.GetServiceName())
+	srv.requests = append([]*request{req}, srv.requests...)
+	broker.prioritize(srv)
+	broker.dispatch(srv)
+}
+
+// checkDeadlines retries the dispatched requests that agents failed to reply
+// to in time.
+func (broker *Broker) checkDeadlines() {
+	now := time.Now()
+	for _, a := range broker.agents {
+		timedOut := false
+		for id, req := range a.inFlight {
+			if now.Before(req.deadline) {
+				continue
+			}
+			delete(a.inFlight, id)
+			timedOut = true
+			if req.broadcast != nil {
+				broker.gatherFailure(req, a, discpb.Error_TIMEOUT, "no reply in time")
+				continue
+			}
+			broker.retry(req, fmt.Sprintf("no reply from agent %s in time", a))
+		}
+		if timedOut {
+			broker.offerAgent(a)
+		}
+	}
+}
+
+// dispatch hands queued requests to matching agents with spare capacity, for
+// as long as there are any. Requests no waiting agent matches stay queued
+// without holding up the ones behind them.
+func (broker *Broker) dispatch(srv *service) {
+	for i := 0; i < len(srv.requests) && len(srv.waiting) > 0; {
+		req := srv.requests[i]
+		a := broker.pickAgent(srv, req)
+		if a == nil {
+			i++
+			continue
+		}
+		srv.requests = append(srv.requests[:i], srv.requests[i+1:]...)
+		broker.assign(a, req)
+	}
+}
+
+// pickAgent lets the service balancer choose among the waiting agents
+// matching the request, returning nil if none match. Retries go to agents that
+// haven't seen the request yet, when there are any.
+func (broker *Broker) pickAgent(srv *service, req *request) *agent {
+	var candidates, untried []*agent
+	for _, a := range srv.waiting {
+		if req.accepts(a) {
+			candidates = append(candidates, a)
+			if !req.tried[a.identity] {
+				untried = append(untried, a)
+			}
+		}
+	}
+	if len(untried) > 0 {
+		candidates = untried
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return srv.balancer.pick(candidates, req)
+}
+
+// accepts reports whether the request can be dispatched to the agent, were
+// it waiting.
+func (req *request) accepts(a *agent) bool {
+	if req.stream != nil && !a.supports(util.FeatureStream) {
+		return false
+	}
+	return req.selector.matches(a.labels)
+}
+
+// joinServices makes the agent a member of the balancers of the services it
+// offers. Only active agents are members.
+func (broker *Broker) joinServices(a *agent) {
+	if a.state != pb.Agent_ACTIVE {
+		return
+	}
+	for _, name := range a.services {
+		broker.getService(name).balancer.add(a)
+	}
+}
+
+// leaveServices takes the agent out of the balancers of the services it
+// offers.
+func (broker *Broker) leaveServices(a *agent) {
+	for _, name := range a.services {
+		if srv, found := broker.services[name]; found {
+			srv.balancer.remove(a)
+		}
+	}
+}
+
+// assign sends the request to the agent.
+func (broker *Broker) assign(a *agent, req *request) {
+	// The agent goes to the back of every waiting list, or off them entirely
+	// once it is busy.
+	broker.withdrawAgent(a)
+	a.inFlight[req.id] = req
+	broker.waitAgent(a)
+
+	req.attempts++
+	req.tried[a.identity] = true
+	req.deadline = time.Now().Add(broker.replyTimeout(req))
+	if req.stream != nil {
+		// The new attempt picks up where the client is.
+		req.stream.next, req.stream.ended = req.stream.acked, false
+	}
+	broker.sendRequest(a, req)
+}
+
+// sendRequest sends the request to the agent, along with the client to reply
+// to.
+func (broker *Broker) sendRequest(a *agent, req *request) {
+	msg := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REQUEST,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Request{Request: &discpb.Request{
+			Payload:     req.msg.GetPayload(),
+			ServiceName: req.msg.GetServiceName(),
+			Client:      []byte(req.client),
+			Id:          req.id,
+		}},
+	}
+	if req.stream != nil {
+		msg.GetRequest().Stream = true
+		msg.GetRequest().ResumeFrom = req.stream.acked
+	}
+	if err := broker.send(a.identity, msg); err != nil {
+		broker.log.Warnf("failed to dispatch request %s to %s: %v", req.id, a, err)
+	}
+}
+
+// replyTimeout returns how long an agent has to reply to the request.
+func (broker *Broker) replyTimeout(req *request) time.Duration {
+	if timeout := broker.serviceCfgs[req.msg.GetServiceName()].ReplyTimeout; timeout != 0 {
+		return timeout
+	}
+	return defaultReplyTimeout
+}
+
+// expireRequests fails the non-durable queued requests that waited too long
+// for an agent.
+func (broker *Broker) expireRequests() {
+	now := time.Now()
+	for _, srv := range broker.services {
+		pending := srv.requests[:0]
+		for _, req := range srv.requests {
+			// Durable requests wait for as long as it takes.
+			if req.msg.GetDurable() || now.Before(req.expiresAt) {
+				pending = append(pending, req)
+				continue
+			}
+			broker.sendError(req.client, req.msg, req.clientID, discpb.Error_NO_MATCHING_AGENT,
+				fmt.Sprintf("no agent for service %q matching %q within %v",
+					srv.name, req.msg.GetLabelSelector(), broker.requestTimeout))
+		}
+		srv.requests = pending
+	}
+}
+
+// sendError fails the client's request.
+func (broker *Broker) sendError(
+	client string, msg *discpb.Request, id string, code discpb.Error_Code, text string) {
+	reply := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REPLY,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Reply{Reply: &discpb.Reply{
+			ServiceName:   msg.GetServiceName(),
+			Id:            id,
+			Error:         &discpb.Error{Code: code, Message: text},
+			CorrelationId: msg.GetCorrelationId(),
+		}},
+	}
+	if err := broker.send(client, reply); err != nil {
+		broker.log.Warnf("failed to return error to %x: %v", client, err)
+	}
+}
+
+// handleRequest queues a client request for its service, unless no local
+// agent offers the service and a peer has capacity for it. Requests forwarded
+// by a peer are never forwarded again.
+func (broker *Broker) handleRequest(client string, msg *discpb.Request, fromPeer bool) {
+	broker.nextRequestID++
+	id := strconv.FormatUint(broker.nextRequestID, 10)
+	clientID := id
+	if fromPeer {
+		clientID = msg.GetId()
+	}
+	if broker.draining {
+		broker.sendError(client, msg, clientID, discpb.Error_UNAVAILABLE, drainReason)
+		return
+	}
+	if msg.GetServiceName() == "" {
+		broker.sendError(client, msg, clientID, discpb.Error_INVALID_REQUEST,
+			"request without a service name")
+		return
+	}
+	// Peers forward the requests of many clients, which their own broker
+	// already rate limited.
+	// Rejections are only counted for the services known already, as
+	// creating them for made up names would grow the registry without bound.
+	// Rate limited requests are counted by sender all the same.
+	if !fromPeer && !broker.allow(client) {
+		if srv, found := broker.services[msg.GetServiceName()]; found {
+			srv.stats.rateLimited++
+		}
+		broker.sendError(client, msg, clientID, discpb.Error_RATE_LIMITED,
+			fmt.Sprintf("over %v requests per second", broker.rateLimit.Rate))
+		return
+	}
+	if isMMI(msg.GetServiceName()) {
+		broker.handleMMI(client, msg, clientID)
+		return
+	}
+	if broker.overQuota(msg.GetServiceName()) {
+		if srv, found := broker.services[msg.GetServiceName()]; found {
+			srv.stats.quotaExceeded++
+		}
+		broker.sendError(client, msg, clientID, discpb.Error_QUOTA_EXCEEDED,
+			fmt.Sprintf("service %q is at its limit of %d requests in progress",
+				msg.GetServiceName(), broker.serviceCfgs[msg.GetServiceName()].MaxInFlight))
+		return
+	}
+	selector, err := parseLabelSelector(msg.GetLabelSelector())
+	if err != nil {
+		broker.sendError(client, msg, clientID, discpb.Error_INVALID_REQUEST, err.Error())
+		return
+	}
+	if err := broker.payloads.CheckRequest(msg.GetServiceName(), msg.GetPayload()); err != nil {
+		broker.sendError(client, msg, clientID, discpb.Error_INVALID_REQUEST, err.Error())
+		return
+	}
+	if msg.GetBroadcast() && msg.GetDurable() {
+		broker.sendError(client, msg, clientID, discpb.Error_INVALID_REQUEST,
+			"broadcast requests can't be durable")
+		return
+	}
+	if msg.GetStream() && (msg.GetBroadcast() || msg.GetDurable()) {
+		broker.sendError(client, msg, clientID, discpb.Error_INVALID_REQUEST,
+			"streamed requests can't be broadcast or durable")
+		return
+	}
+	req := &request{
+		id:        id,
+		clientID:  clientID,
+		client:    client,
+		msg:       msg,
+		selector:  selector,
+		expiresAt: time.Now().Add(broker.requestTimeout),
+		tried:     make(map[string]bool),
+	}
+	if msg.GetStream() {
+		var err error
+		if req.stream, err = newStream(); err != nil {
+			broker.log.Errorf("failed to start stream %s: %v", id, err)
+			broker.sendError(client, msg, clientID, discpb.Error_UNAVAILABLE,
+				"failed to start the stream")
+			return
+		}
+	}
+	if msg.GetDurable() {
+		if broker.journal == nil {
+			broker.sendError(client, msg, clientID, discpb.Error_INVALID_REQUEST,
+				"durable requests are not enabled on this broker")
+			return
+		}
+		if err := broker.journalRequest(req); err != nil {
+			broker.log.Errorf("failed to journal request %s: %v", id, err)
+			broker.sendError(client, msg, clientID, discpb.Error_UNAVAILABLE,
+				"failed to journal the request")
+			return
+		}
+	}
+	broker.getService(msg.GetServiceName()).stats.requests++
+	if msg.GetBroadcast() {
+		broker.scatter(req)
+		return
+	}
+	// Peers relay neither durable nor streamed requests.
+	if !msg.GetDurable() && !msg.GetStream() && !fromPeer &&
+		!broker.offeredLocally(msg.GetServiceName()) && broker.forward(req) {
+		return
+	}
+	broker.enqueue(req)
+}
+
+// handleReply routes an agent's reply back to the requesting client and makes
+// the agent available again.
+func (broker *Broker) handleReply(identity string, msg *discpb.Reply) {
+	a, found := broker.agents[identity]
+	if !found {
+		broker.log.Warnf("dropping reply from unknown agent %x", identity)
+		return
+	}
+	req, found := a.inFlight[msg.GetId()]
+	if !found {
+		broker.log.Warnf("dropping unexpected reply %q from %s", msg.GetId(), a)
+		return
+	}
+	delete(a.inFlight, req.id)
+	// Failed requests carry an error instead of a payload.
+	err := broker.payloads.CheckReply(req.msg.GetServiceName(), msg.GetPayload())
+	if err != nil && msg.GetError() == nil {
+		broker.log.Warnf("Agent %s replied to request %s with an invalid payload: %v", a, req.id, err)
+		msg = &discpb.Reply{
+			Id:    msg.GetId(),
+			Error: &discpb.Error{Code: discpb.Error_INVALID_REPLY, Message: err.Error()},
+		}
+	}
+	if req.broadcast != nil {
+		if !req.broadcast.done {
+			broker.gather(req, a, msg)
+		}
+		broker.offerAgent(a)
+		return
+	}
+	broker.completeRequest(req)
+	broker.getService(req.msg.GetServiceName()).stats.replies++
+
+	reply := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REPLY,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Reply{Reply: &discpb.Reply{
+			Payload:       msg.GetPayload(),
+			ServiceName:   req.msg.GetServiceName(),
+			Id:            req.clientID,
+			Error:         msg.GetError(),
+			CorrelationId: req.msg.GetCorrelationId(),
+		}},
+	}
+	if err := broker.send(req.client, reply); err != nil {
+		broker.log.Warnf("failed to return reply %s to %x: %v", req.id, req.client, err)
+	}
+	broker.offerAgent(a)
+}
@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+const (
+	defaultDrainTimeout = time.Duration(10) * time.Second
+	drainPollInterval   = time.Duration(100) * time.Millisecond
+	drainReason         = "Olympus is shutting down"
+)
+
+// The drain methods below must be called with broker.mu held.
+
+// drainMsg asks an agent to finish its current work and disconnect by the
+// deadline.
+func drainMsg(deadline time.Time) *discpb.DiscoveryMessage {
+	return &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_DISCONNECT,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Disconnect{Disconnect: &discpb.Disconnect{
+			ExpirationTime: timestamppb.New(deadline),
+			Reason:         drainReason,
+		}},
+	}
+}
+
+// drain stops the broker from taking on new work. Agents are told to
+// disconnect once done with the requests they are working on, queued requests
+// are failed and watchers are let go.
+func (broker *Broker) drain(deadline time.Time) {
+	broker.draining = true
+	broker.drainDeadline = deadline
+	msg := drainMsg(deadline)
+	for identity, a := range broker.agents {
+		broker.withdrawAgent(a)
+		// Agents that can't drain are waited for all the same.
+		if !a.supports(util.FeatureDrain) {
+			continue
+		}
+		if err := broker.send(identity, msg); err != nil {
+			broker.log.Warnf("failed to drain agent %s: %v", a, err)
+		}
+	}
+	broker.failQueued()
+	for w := range broker.watchers {
+		broker.removeWatcher(w)
+	}
+}
+
+// failQueued fails the requests that are waiting for an agent. Durable
+// requests stay in the journal, to be replayed on the next run.
+func (broker *Broker) failQueued() {
+	for _, srv := range broker.services {
+		for _, req := range srv.requests {
+			if req.msg.GetDurable() && broker.journal != nil {
+				continue
+			}
+			broker.sendError(req.client, req.msg, req.clientID, discpb.Error_UNAVAILABLE, drainReason)
+		}
+		srv.requests = nil
+	}
+}
+
+// inFlight counts the requests the agents and peers are still working on.
+func (broker *Broker) inFlight() (n int) {
+	for _, a := range broker.agents {
+		n += len(a.inFlight)
+	}
+	for _, p := range broker.peers {
+		n += len(p.forwarded)
+	}
+	return
+}
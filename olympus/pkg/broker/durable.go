@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/project-auxo/auxo/olympus/pkg/journal"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+// openJournal opens the journal of durable requests.
+func (broker *Broker) openJournal(path string) (err error) {
+	broker.journal, err = journal.Open(path)
+	return
+}
+
+// The methods below must be called with broker.mu held.
+
+// replayJournal queues the durable requests that were still pending when the
+// broker last stopped, or when the previous leader failed.
+func (broker *Broker) replayJournal() {
+	// Carry on numbering requests past every ID journaled, so that none is
+	// reused.
+	if n, err := strconv.ParseUint(broker.journal.Highest(), 10, 64); err == nil &&
+		n > broker.nextRequestID {
+		broker.nextRequestID = n
+	}
+	pending := broker.journal.Pending()
+	if len(pending) > 0 {
+		broker.log.Infof("Replaying %d journaled request(s)", len(pending))
+	}
+	for _, entry := range pending {
+		msg := &discpb.Request{}
+		if err := proto.Unmarshal(entry.Data, msg); err != nil {
+			broker.log.Errorf("skipping unreadable journaled request %s: %v", entry.ID, err)
+			continue
+		}
+		// The selector was valid when the request was journaled.
+		selector, _ := parseLabelSelector(msg.GetLabelSelector())
+		req := &request{
+			id:        entry.ID,
+			clientID:  entry.ID,
+			client:    string(msg.GetClient()),
+			msg:       msg,
+			selector:  selector,
+			expiresAt: time.Now().Add(broker.requestTimeout),
+			tried:     make(map[string]bool),
+		}
+		broker.enqueue(req)
+	}
+}
+
+// journalRequest durably records the request along with the client to reply
+// to, and acknowledges it to the client.
+func (broker *Broker) journalRequest(req *request) (err error) {
+	record := proto.Clone(req.msg).(*discpb.Request)
+	record.Client = []byte(req.client)
+	record.Id = req.id
+	data, err := proto.Marshal(record)
+	if err != nil {
+		return
+	}
+	if err = broker.journal.Append(req.id, data); err != nil {
+		return
+	}
+	broker.replicateAppend(req.id, data)
+	ack := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_ACK,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Ack{Ack: &discpb.Ack{
+			Id:            req.clientID,
+			CorrelationId: req.msg.GetCorrelationId(),
+		}},
+	}
+	if err := broker.send(req.client, ack); err != nil {
+		broker.log.Warnf("failed to acknowledge request %s: %v", req.id, err)
+	}
+	return nil
+}
+
+// completeRequest removes a durable request from the journal.
+func (broker *Broker) completeRequest(req *request) {
+	if !req.msg.GetDurable() || broker.journal == nil {
+		return
+	}
+	if err := broker.journal.Done(req.id); err != nil {
+		broker.log.Errorf("failed to journal completion of request %s: %v", req.id, err)
+	}
+	broker.replicateDone(req.id)
+}
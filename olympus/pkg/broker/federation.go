@@ -0,0 +1,327 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+	"google.golang.org/protobuf/proto"
+
+	brokerConfig "github.com/project-auxo/auxo/olympus/internal/config"
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+// Prefix of the routing identity of a broker's DEALER sockets to its peers,
+// followed by the broker's name.
+const peerIdentityPrefix = "olympus-peer:"
+
+// peer is another broker, which requests for services without local agents
+// are forwarded to. The broker connects to every peer with a DEALER socket,
+// over which it sends its summaries and forwarded requests, and the peer
+// replies. The peer's summaries and forwarded requests come in on the ROUTER
+// socket, see peerFor.
+type peer struct {
+	name      string
+	endpoint  string
+	publicKey string // Empty when the peer is plaintext
+	socket    *zmq.Socket
+	services  map[string]*discpb.ServiceAvailability // Keyed by service name
+	summaryAt time.Time                              // When the last summary came in
+	forwarded map[string]*request                    // Keyed by request id
+}
+
+func (p *peer) String() string {
+	return p.name
+}
+
+// alive reports whether the peer's summary is recent enough to rely on.
+func (p *peer) alive() bool {
+	return time.Since(p.summaryAt) < heartbeatExpiry
+}
+
+// connectPeers opens the sockets to the configured peers.
+func (broker *Broker) connectPeers(peers []brokerConfig.Peer) (err error) {
+	for _, cfg := range peers {
+		p := &peer{
+			name:      cfg.Name,
+			endpoint:  cfg.Endpoint,
+			services:  make(map[string]*discpb.ServiceAvailability),
+			forwarded: make(map[string]*request),
+		}
+		if p.socket, err = zmq.NewSocket(zmq.DEALER); err != nil {
+			return
+		}
+		if err = p.socket.SetIdentity(peerIdentityPrefix + broker.name); err != nil {
+			p.socket.Close()
+			return fmt.Errorf("peer %s: %v", p, err)
+		}
+		if err = broker.authenticatePeer(p, cfg); err != nil {
+			p.socket.Close()
+			return fmt.Errorf("peer %s: %v", p, err)
+		}
+		if err = p.socket.Connect(p.endpoint); err != nil {
+			p.socket.Close()
+			return fmt.Errorf("peer %s: %v", p, err)
+		}
+		broker.peers[p.name] = p
+		broker.poller.Add(p.socket, zmq.POLLIN)
+	}
+	return
+}
+
+// authenticatePeer presents the broker's keypair to a peer using CURVE.
+func (broker *Broker) authenticatePeer(p *peer, cfg brokerConfig.Peer) error {
+	if cfg.PublicKeyFile == "" {
+		return nil
+	}
+	if broker.curve == nil {
+		return errors.New("public_key_file requires a CURVE keypair for the broker")
+	}
+	serverKey, err := util.ReadCurveKey(cfg.PublicKeyFile)
+	if err != nil {
+		return err
+	}
+	p.publicKey = serverKey
+	return p.socket.ClientAuthCurve(serverKey, broker.curve.public, broker.curve.secret)
+}
+
+// peerFor returns the peer behind the sender of a message on the ROUTER
+// socket, or nil if the sender isn't a peer. Peers connect with the routing
+// identity made of peerIdentityPrefix and their name and, when the broker uses
+// CURVE, with the public key configured for them, which is the user ID of the
+// sender. Without CURVE, the routing identity is all there is to go by.
+func (broker *Broker) peerFor(identity, userID string) *peer {
+	if !strings.HasPrefix(identity, peerIdentityPrefix) {
+		return nil
+	}
+	p, found := broker.peers[strings.TrimPrefix(identity, peerIdentityPrefix)]
+	if !found {
+		return nil
+	}
+	if broker.curve != nil && userID != p.publicKey {
+		broker.log.Warnf("Sender %x claims to be peer %s with another key", identity, p)
+		return nil
+	}
+	return p
+}
+
+// peerBySocket returns the peer the socket connects to, if any.
+func (broker *Broker) peerBySocket(socket *zmq.Socket) *peer {
+	for _, p := range broker.peers {
+		if p.socket == socket {
+			return p
+		}
+	}
+	return nil
+}
+
+// recvPeer handles the next message from a peer on its DEALER socket.
+func (broker *Broker) recvPeer(p *peer) (err error) {
+	frames, err := p.socket.RecvMessageBytes(0)
+	if err != nil {
+		return
+	}
+	body, _, err := util.OpenEnvelope(frames)
+	if err != nil {
+		return fmt.Errorf("message from peer %s: %v", p, err)
+	}
+	msg, err := util.UnmarshalDiscoveryMessage(body)
+	if err != nil {
+		return fmt.Errorf("message from peer %s: %v", p, err)
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	switch msg.GetHeader() {
+	case discpb.Header_HEADER_REPLY:
+		broker.handlePeerReply(p, msg.GetReply())
+	default:
+		broker.log.Debugf("Ignoring %s from peer %s", msg.GetHeader(), p)
+	}
+	return
+}
+
+// The federation methods below must be called with broker.mu held.
+
+// summary describes the services the broker can serve with its own agents.
+func (broker *Broker) summary() *discpb.Summary {
+	summary := &discpb.Summary{Name: broker.name}
+	if broker.draining {
+		return summary
+	}
+	availability := make(map[string]*discpb.ServiceAvailability)
+	for _, a := range broker.agents {
+		for _, name := range a.services {
+			s, found := availability[name]
+			if !found {
+				s = &discpb.ServiceAvailability{Name: name}
+				availability[name] = s
+				summary.Services = append(summary.Services, s)
+			}
+			s.Agents++
+			if spare := a.maxConcurrency - len(a.inFlight); spare > 0 {
+				s.Capacity += uint32(spare)
+			}
+		}
+	}
+	// Requests queued locally have first claim on the capacity.
+	for name, srv := range broker.services {
+		s, found := availability[name]
+		if !found {
+			continue
+		}
+		if queued := uint32(len(srv.requests)); queued < s.Capacity {
+			s.Capacity -= queued
+		} else {
+			s.Capacity = 0
+		}
+	}
+	return summary
+}
+
+// sendSummaries tells every peer about the services available locally. The
+// summaries double as heartbeats.
+func (broker *Broker) sendSummaries() {
+	if len(broker.peers) == 0 {
+		return
+	}
+	msg := &discpb.DiscoveryMessage{
+		Header:  discpb.Header_HEADER_SUMMARY,
+		Origin:  &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Summary{Summary: broker.summary()},
+	}
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		broker.log.Warnf("failed to marshal summary: %v", err)
+		return
+	}
+	for _, p := range broker.peers {
+		if _, err := p.socket.SendMessageDontwait(util.Envelope(util.ProtocolVersion, msgBytes)); err != nil {
+			broker.log.Debugf("failed to send summary to peer %s: %v", p, err)
+		}
+	}
+}
+
+// handleSummary records the services available behind a peer. Summaries
+// only count from the peer they name, as identified by peerFor.
+func (broker *Broker) handleSummary(identity string, p *peer, summary *discpb.Summary) {
+	if p == nil || p.name != summary.GetName() {
+		broker.log.Debugf("Ignoring summary for %q from %x", summary.GetName(), identity)
+		return
+	}
+	if !p.alive() {
+		broker.log.Infof("Peer %s is up", p)
+	}
+	p.summaryAt = time.Now()
+	p.services = make(map[string]*discpb.ServiceAvailability)
+	for _, s := range summary.GetServices() {
+		p.services[s.GetName()] = s
+	}
+}
+
+// offeredLocally reports whether any local agent offers the service.
+func (broker *Broker) offeredLocally(service string) bool {
+	for _, a := range broker.agents {
+		if a.offers(service) {
+			return true
+		}
+	}
+	return false
+}
+
+// pickPeer returns the live peer with the most capacity for the service, or
+// nil if no peer has any.
+func (broker *Broker) pickPeer(service string) (best *peer) {
+	var bestCapacity uint32
+	for _, p := range broker.peers {
+		if !p.alive() {
+			continue
+		}
+		if capacity := p.services[service].GetCapacity(); capacity > bestCapacity {
+			best, bestCapacity = p, capacity
+		}
+	}
+	return
+}
+
+// forward sends the request to a peer with capacity for its service. It
+// returns false when no peer has any, leaving the request to the caller.
+func (broker *Broker) forward(req *request) bool {
+	p := broker.pickPeer(req.msg.GetServiceName())
+	if p == nil {
+		return false
+	}
+	msg := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REQUEST,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Request{Request: &discpb.Request{
+			Payload:       req.msg.GetPayload(),
+			ServiceName:   req.msg.GetServiceName(),
+			Id:            req.id,
+			LabelSelector: req.msg.GetLabelSelector(),
+			Key:           req.msg.GetKey(),
+			Priority:      req.msg.GetPriority(),
+		}},
+	}
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		return false
+	}
+	if _, err := p.socket.SendMessageDontwait(util.Envelope(util.ProtocolVersion, msgBytes)); err != nil {
+		broker.log.Warnf("failed to forward request %s to peer %s: %v", req.id, p, err)
+		return false
+	}
+	// The peer waits for an agent and for its reply, give it time for both.
+	req.attempts++
+	req.deadline = time.Now().Add(broker.requestTimeout + broker.replyTimeout(req))
+	p.forwarded[req.id] = req
+	// Until the next summary, assume the peer's capacity is taken.
+	p.services[req.msg.GetServiceName()].Capacity--
+	broker.log.Debugf("Forwarded request %s for %q to peer %s",
+		req.id, req.msg.GetServiceName(), p)
+	return true
+}
+
+// handlePeerReply routes a peer's reply to a forwarded request back to the
+// requesting client.
+func (broker *Broker) handlePeerReply(p *peer, msg *discpb.Reply) {
+	req, found := p.forwarded[msg.GetId()]
+	if !found {
+		broker.log.Warnf("dropping unexpected reply %q from peer %s", msg.GetId(), p)
+		return
+	}
+	delete(p.forwarded, req.id)
+	broker.getService(req.msg.GetServiceName()).stats.replies++
+	reply := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REPLY,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Reply{Reply: &discpb.Reply{
+			Payload:       msg.GetPayload(),
+			ServiceName:   req.msg.GetServiceName(),
+			Id:            req.id,
+			Error:         msg.GetError(),
+			CorrelationId: req.msg.GetCorrelationId(),
+		}},
+	}
+	if err := broker.send(req.client, reply); err != nil {
+		broker.log.Warnf("failed to return reply %s to %x: %v", req.id, req.client, err)
+	}
+}
+
+// checkForwarded fails the forwarded requests the peers did not reply to in
+// time.
+func (broker *Broker) checkForwarded() {
+	now := time.Now()
+	for _, p := range broker.peers {
+		for id, req := range p.forwarded {
+			if now.Before(req.deadline) {
+				continue
+			}
+			delete(p.forwarded, id)
+			broker.sendError(req.client, req.msg, req.id, discpb.Error_UNAVAILABLE,
+				fmt.Sprintf("no reply from peer %s in time", p))
+		}
+	}
+}
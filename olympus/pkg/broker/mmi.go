@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/project-auxo/auxo/olympus/pkg/payload"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
+)
+
+// Requests for the services prefixed with mmiPrefix are answered by the broker
+// itself, Majordomo management interface style, so that ZMQ clients can query
+// the registry without going through the gRPC frontend:
+//
+//   - mmi.service takes the service name as a StringValue and returns its
+//     ServiceAvailability.
+//   - mmi.agents takes an optional ListAgentsReq and returns a ListAgentsRep.
+//   - mmi.stats returns a GetStatsRep.
+const mmiPrefix = "mmi."
+
+// isMMI reports whether the service name is reserved for the broker.
+func isMMI(service string) bool {
+	return strings.HasPrefix(service, mmiPrefix)
+}
+
+// reservedServices returns the services of the list that are reserved for the
+// broker.
+func reservedServices(services []string) (reserved []string) {
+	for _, name := range services {
+		if isMMI(name) {
+			reserved = append(reserved, name)
+		}
+	}
+	return
+}
+
+// The MMI methods below must be called with broker.mu held.
+
+// handleMMI answers a request for a management service.
+func (broker *Broker) handleMMI(client string, msg *discpb.Request, id string) {
+	var rep proto.Message
+	var err error
+	switch msg.GetServiceName() {
+	case "mmi.service":
+		rep, err = broker.mmiService(msg.GetPayload())
+	case "mmi.agents":
+		rep, err = broker.mmiAgents(msg.GetPayload())
+	case "mmi.stats":
+		rep = broker.stats()
+	default:
+		err = fmt.Errorf("unknown management service %q", msg.GetServiceName())
+	}
+	if err != nil {
+		broker.sendError(client, msg, id, discpb.Error_INVALID_REQUEST, err.Error())
+		return
+	}
+	p, err := payload.Pack(rep)
+	if err != nil {
+		broker.log.Warnf("failed to marshal %s reply: %v", msg.GetServiceName(), err)
+		return
+	}
+	reply := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REPLY,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Reply{Reply: &discpb.Reply{
+			Payload:       p,
+			ServiceName:   msg.GetServiceName(),
+			Id:            id,
+			CorrelationId: msg.GetCorrelationId(),
+		}},
+	}
+	if err := broker.send(client, reply); err != nil {
+		broker.log.Warnf("failed to return %s reply to %x: %v", msg.GetServiceName(), client, err)
+	}
+}
+
+// mmiService reports how much of the named service the local agents can serve.
+func (broker *Broker) mmiService(p *anypb.Any) (*discpb.ServiceAvailability, error) {
+	name := &wrapperspb.StringValue{}
+	if err := payload.Unpack(p, name); err != nil {
+		return nil, fmt.Errorf("mmi.service expects the service name: %v", err)
+	}
+	availability := &discpb.ServiceAvailability{Name: name.GetValue()}
+	for _, a := range broker.agents {
+		if a.state != pb.Agent_ACTIVE || !a.offers(name.GetValue()) {
+			continue
+		}
+		availability.Agents++
+		if spare := a.maxConcurrency - len(a.inFlight); spare > 0 {
+			availability.Capacity += uint32(spare)
+		}
+	}
+	return availability, nil
+}
+
+// mmiAgents lists the agents like the ListAgents RPC does.
+func (broker *Broker) mmiAgents(p *anypb.Any) (*pb.ListAgentsRep, error) {
+	req := &pb.ListAgentsReq{}
+	if p != nil {
+		if err := payload.Unpack(p, req); err != nil {
+			return nil, fmt.Errorf("mmi.agents expects a ListAgentsReq: %v", err)
+		}
+	}
+	return broker.listAgents(req)
+}
@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"sort"
+	"time"
+
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+const defaultPriorityAging = time.Duration(30) * time.Second
+
+// rank orders the priorities, the lowest rank being served first.
+func rank(priority discpb.Request_Priority) int {
+	switch priority {
+	case discpb.Request_INTERACTIVE:
+		return 0
+	case discpb.Request_BACKGROUND:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// The priority methods below must be called with broker.mu held.
+
+// effectiveRank is the rank of the request, promoted by one for every aging
+// period it has been queued for.
+func (broker *Broker) effectiveRank(req *request, now time.Time) int {
+	r := rank(req.msg.GetPriority()) - int(now.Sub(req.queuedAt)/broker.priorityAging)
+	if r < 0 {
+		return 0
+	}
+	return r
+}
+
+// prioritize orders the queue of the service by effective rank. Requests of
+// the same rank keep their order, so that retries stay ahead and the others
+// are served oldest first.
+func (broker *Broker) prioritize(srv *service) {
+	now := time.Now()
+	sort.SliceStable(srv.requests, func(i, j int) bool {
+		return broker.effectiveRank(srv.requests[i], now) <
+			broker.effectiveRank(srv.requests[j], now)
+	})
+}
+
+// agePriorities reorders the queues as the requests in them age.
+func (broker *Broker) agePriorities() {
+	for _, srv := range broker.services {
+		broker.prioritize(srv)
+	}
+}
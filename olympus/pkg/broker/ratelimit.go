@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"encoding/hex"
+	"math"
+	"sort"
+	"time"
+
+	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
+)
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// take takes a token if there is one left.
+func (b *tokenBucket) take(rate, burst float64, now time.Time) bool {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updatedAt).Seconds()*rate)
+	b.updatedAt = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sender is a client or agent the broker is rate limiting.
+type sender struct {
+	bucket      tokenBucket
+	rateLimited uint64
+}
+
+// serviceStats counts the requests of a service.
+type serviceStats struct {
+	requests      uint64
+	replies       uint64
+	rateLimited   uint64
+	quotaExceeded uint64
+}
+
+// The rate limiting methods below must be called with broker.mu held.
+
+// allow reports whether the sender is within its rate limit.
+func (broker *Broker) allow(identity string) bool {
+	if broker.rateLimit.Rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	s, found := broker.senders[identity]
+	if !found {
+		s = &sender{bucket: tokenBucket{tokens: broker.burst(), updatedAt: now}}
+		broker.senders[identity] = s
+	}
+	if s.bucket.take(broker.rateLimit.Rate, broker.burst(), now) {
+		return true
+	}
+	s.rateLimited++
+	return false
+}
+
+func (broker *Broker) burst() float64 {
+	if broker.rateLimit.Burst > 0 {
+		return float64(broker.rateLimit.Burst)
+	}
+	return math.Max(1, broker.rateLimit.Rate)
+}
+
+// forgetSenders drops the senders that have been idle long enough for their
+// bucket to fill up again, keeping count of their rate limited requests.
+func (broker *Broker) forgetSenders() {
+	if broker.rateLimit.Rate <= 0 {
+		return
+	}
+	refill := time.Duration(broker.burst() / broker.rateLimit.Rate * float64(time.Second))
+	now := time.Now()
+	for identity, s := range broker.senders {
+		if now.Sub(s.bucket.updatedAt) > refill {
+			broker.idleLimited += s.rateLimited
+			delete(broker.senders, identity)
+		}
+	}
+}
+
+// overQuota reports whether the service has as many requests queued or in
+// flight as it may.
+func (broker *Broker) overQuota(name string) bool {
+	max := broker.serviceCfgs[name].MaxInFlight
+	if max <= 0 {
+		return false
+	}
+	queued, inFlight := broker.pendingRequests(name)
+	return queued+inFlight >= max
+}
+
+// pendingRequests counts the requests of the service waiting for an agent,
+// and those dispatched or forwarded but not replied to yet.
+func (broker *Broker) pendingRequests(name string) (queued, inFlight int) {
+	if srv, found := broker.services[name]; found {
+		queued = len(srv.requests)
+	}
+	for _, a := range broker.agents {
+		for _, req := range a.inFlight {
+			if req.msg.GetServiceName() == name {
+				inFlight++
+			}
+		}
+	}
+	for _, p := range broker.peers {
+		for _, req := range p.forwarded {
+			if req.msg.GetServiceName() == name {
+				inFlight++
+			}
+		}
+	}
+	return
+}
+
+// stats reports the request counters, by service name and sender identity.
+func (broker *Broker) stats() *pb.GetStatsRep {
+	rep := &pb.GetStatsRep{IdleSendersRateLimited: broker.idleLimited}
+	for name, srv := range broker.services {
+		queued, inFlight := broker.pendingRequests(name)
+		rep.Services = append(rep.Services, &pb.ServiceStats{
+			Name:          name,
+			Requests:      srv.stats.requests,
+			Replies:       srv.stats.replies,
+			RateLimited:   srv.stats.rateLimited,
+			QuotaExceeded: srv.stats.quotaExceeded,
+			Queued:        uint32(queued),
+			InFlight:      uint32(inFlight),
+		})
+	}
+	sort.Slice(rep.Services, func(i, j int) bool {
+		return rep.Services[i].Name < rep.Services[j].Name
+	})
+	for identity, s := range broker.senders {
+		if s.rateLimited > 0 {
+			rep.Senders = append(rep.Senders, &pb.SenderStats{
+				Identity:    hex.EncodeToString([]byte(identity)),
+				RateLimited: s.rateLimited,
+			})
+		}
+	}
+	sort.Slice(rep.Senders, func(i, j int) bool {
+		return rep.Senders[i].Identity < rep.Senders[j].Identity
+	})
+	return rep
+}
@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
+)
+
+// agent is the broker's view of an Apollo agent connected to the ROUTER
+// socket.
+type agent struct {
+	identity        string // ZMQ routing identity
+	name            string
+	services        []string
+	protocolVersion uint32          // Negotiated with the agent
+	features        map[string]bool // Negotiated with the agent
+	labels          map[string]string
+	maxConcurrency  int
+	connectedAt     time.Time
+	lastHeartbeat   time.Time
+	inFlight        map[string]*request // Dispatched requests, keyed by ID
+	state           pb.Agent_State
+	drainDeadline   time.Time // When a draining agent has to be gone by
+	drainReason     string
+}
+
+func (a *agent) String() string {
+	return fmt.Sprintf("%x", a.identity)
+}
+
+// offers reports whether the agent offers the service.
+func (a *agent) offers(service string) bool {
+	for _, name := range a.services {
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
+
+// supports reports whether the agent supports the feature.
+func (a *agent) supports(feature string) bool {
+	return a.features[feature]
+}
+
+// hasCapacity reports whether the agent can take on another request.
+func (a *agent) hasCapacity() bool {
+	return len(a.inFlight) < a.maxConcurrency
+}
+
+// The registry methods below must be called with broker.mu held.
+
+// registerAgent adds the agent behind the given routing identity to the
+// registry, speaking the negotiated protocol version. A READY from an already
+// known identity replaces the services it previously offered.
+func (broker *Broker) registerAgent(
+	identity string, ready *discpb.Ready, version uint32) *agent {
+	now := time.Now()
+	a, found := broker.agents[identity]
+	previousServices := []string{}
+	if found {
+		broker.withdrawAgent(a)
+		broker.leaveServices(a)
+		previousServices = a.services
+	} else {
+		a = &agent{
+			identity:    identity,
+			connectedAt: now,
+			inFlight:    make(map[string]*request),
+			state:       pb.Agent_ACTIVE,
+		}
+		broker.agents[identity] = a
+	}
+	a.name = ready.GetName()
+	a.services = ready.GetServices()
+	a.protocolVersion = version
+	a.features = make(map[string]bool)
+	for _, feature := range util.NegotiateFeatures(version, ready.GetFeatures()) {
+		a.features[feature] = true
+	}
+	a.labels = ready.GetLabels()
+	a.maxConcurrency = int(ready.GetMaxConcurrency())
+	if a.maxConcurrency < 1 || !a.supports(util.FeatureConcurrency) {
+		a.maxConcurrency = 1
+	}
+	a.lastHeartbeat = now
+	broker.joinServices(a)
+	broker.offerAgent(a)
+
+	if !found {
+		broker.publish(pb.AgentEvent_CONNECTED, a)
+	} else if !sameServices(previousServices, a.services) {
+		broker.publish(pb.AgentEvent_SERVICES_CHANGED, a, previousServices...)
+	}
+	return a
+}
+
+// welcome tells an agent speaking version 2 or later what was negotiated.
+func (broker *Broker) welcome(a *agent) {
+	if !util.Welcomes(a.protocolVersion) {
+		return
+	}
+	broker.send(a.identity, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_WELCOME,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Welcome{Welcome: &discpb.Welcome{
+			ProtocolVersion: a.protocolVersion,
+			Features:        a.featureList(),
+		}},
+	})
+}
+
+// featureList returns the negotiated features of the agent, sorted.
+func (a *agent) featureList() (features []string) {
+	for feature := range a.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return
+}
+
+// reject disconnects the sender of a READY the broker can't serve.
+func (broker *Broker) reject(identity, reason string) {
+	broker.log.Warnf("Rejecting agent %x: %s", identity, reason)
+	broker.send(identity, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_DISCONNECT,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Disconnect{
+			Disconnect: &discpb.Disconnect{Reason: reason}},
+	})
+}
+
+func sameServices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	offered := make(map[string]bool, len(a))
+	for _, s := range a {
+		offered[s] = true
+	}
+	for _, s := range b {
+		if !offered[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshAgent records a sign of life from the agent, returning false if the
+// identity is not registered.
+func (broker *Broker) refreshAgent(identity string) bool {
+	a, found := broker.agents[identity]
+	if !found {
+		return false
+	}
+	a.lastHeartbeat = time.Now()
+	return true
+}
+
+// deleteAgent removes the agent from the registry, reporting why to the
+// watchers. Requests it was working on are retried.
+func (broker *Broker) deleteAgent(identity string, reason pb.AgentEvent_Type) {
+	a, found := broker.agents[identity]
+	if !found {
+		return
+	}
+	broker.publish(reason, a)
+	broker.withdrawAgent(a)
+	broker.leaveServices(a)
+	delete(broker.agents, identity)
+	for id, req := range a.inFlight {
+		delete(a.inFlight, id)
+		if req.broadcast != nil {
+			broker.gatherFailure(req, a, discpb.Error_UNAVAILABLE, "agent went away")
+			continue
+		}
+		broker.retry(req, fmt.Sprintf("agent %s went away", a))
+	}
+}
+
+// purgeAgents removes and returns the agents that missed too many heartbeats.
+func (broker *Broker) purgeAgents() (expired []*agent) {
+	now := time.Now()
+	for identity, a := range broker.agents {
+		if now.Sub(a.lastHeartbeat) > heartbeatExpiry {
+			expired = append(expired, a)
+			broker.deleteAgent(identity, pb.AgentEvent_EXPIRED)
+		}
+	}
+	return
+}
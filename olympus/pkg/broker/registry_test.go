@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+	"google.golang.org/protobuf/proto"
+
+	brokerConfig "github.com/project-auxo/auxo/olympus/internal/config"
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+const registryTestPort = 25590
+
+// startBroker runs a broker bound to the given port on its broker loop.
+func startBroker(t *testing.T, port int) *Broker {
+	t.Helper()
+	broker, err := New(&brokerConfig.Config{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	broker.bind(fmt.Sprintf("tcp://*:%d", port))
+	go broker.handle()
+	return broker
+}
+
+// connectAgent connects a socket to the broker on the given port, as an agent
+// does.
+func connectAgent(t *testing.T, port int) *zmq.Socket {
+	t.Helper()
+	socket, err := zmq.NewSocket(zmq.DEALER)
+	if err != nil {
+		t.Fatalf("NewSocket: %v", err)
+	}
+	if err = socket.Connect(fmt.Sprintf("tcp://localhost:%d", port)); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return socket
+}
+
+// sendReady announces an agent offering echo, without an envelope as no
+// version is negotiated yet.
+func sendReady(t *testing.T, socket *zmq.Socket, version uint32, features ...string) {
+	t.Helper()
+	msgBytes, err := proto.Marshal(&discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_READY,
+		Origin: &discpb.Entity{Type: discpb.Entity_AGENT},
+		Command: &discpb.DiscoveryMessage_Ready{Ready: &discpb.Ready{
+			Name:            "echo-agent",
+			Services:        []string{"echo"},
+			ProtocolVersion: version,
+			MaxConcurrency:  4,
+			Features:        features,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if _, err = socket.SendMessage(msgBytes); err != nil {
+		t.Fatalf("send READY: %v", err)
+	}
+}
+
+// recvWithin returns the next message from the broker other than a heartbeat,
+// or nil if none comes in time, along with the version of its envelope.
+func recvWithin(t *testing.T, socket *zmq.Socket, timeout time.Duration) (
+	*discpb.DiscoveryMessage, uint32) {
+	t.Helper()
+	poller := zmq.NewPoller()
+	poller.Add(socket, zmq.POLLIN)
+	deadline := time.Now().Add(timeout)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, 0
+		}
+		polled, err := poller.Poll(left)
+		if err != nil {
+			t.Fatalf("Poll: %v", err)
+		}
+		if len(polled) == 0 {
+			return nil, 0
+		}
+		frames, err := socket.RecvMessageBytes(0)
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		body, version, err := util.OpenEnvelope(frames)
+		if err != nil {
+			t.Fatalf("OpenEnvelope: %v", err)
+		}
+		msg, err := util.UnmarshalDiscoveryMessage(body)
+		if err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if msg.GetHeader() != discpb.Header_HEADER_HEARTBEAT {
+			return msg, version
+		}
+	}
+}
+
+// onlyAgent returns the version and features the broker negotiated with its
+// only agent.
+func onlyAgent(t *testing.T, broker *Broker) (version uint32, features []string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		found := false
+		broker.do(func() {
+			for _, a := range broker.agents {
+				version, features, found = a.protocolVersion, a.featureList(), true
+			}
+		})
+		if found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the agent never registered")
+	return
+}
+
+func TestReadyOfVersion1(t *testing.T) {
+	broker := startBroker(t, registryTestPort)
+	defer stopBroker(broker)
+	socket := connectAgent(t, registryTestPort)
+	defer socket.Close()
+
+	sendReady(t, socket, 0)
+	version, features := onlyAgent(t, broker)
+	if version != 1 {
+		t.Errorf("negotiated version %d, want 1", version)
+	}
+	if want := []string{util.FeatureConcurrency}; !reflect.DeepEqual(features, want) {
+		t.Errorf("negotiated features %v, want %v", features, want)
+	}
+	if msg, _ := recvWithin(t, socket, 2*heartbeatInterval); msg != nil {
+		t.Errorf("agent of version 1 got %s, which it predates", msg.GetHeader())
+	}
+}
+
+func TestReadyIsWelcomed(t *testing.T) {
+	broker := startBroker(t, registryTestPort+1)
+	defer stopBroker(broker)
+	socket := connectAgent(t, registryTestPort+1)
+	defer socket.Close()
+
+	sendReady(t, socket, util.ProtocolVersion+1, util.FeatureStream, "teleport")
+	msg, version := recvWithin(t, socket, time.Second)
+	if msg.GetHeader() != discpb.Header_HEADER_WELCOME {
+		t.Fatalf("got %v, want WELCOME", msg)
+	}
+	if version != util.ProtocolVersion {
+		t.Errorf("WELCOME in an envelope of version %d, want %d", version, util.ProtocolVersion)
+	}
+	welcome := msg.GetWelcome()
+	if welcome.GetProtocolVersion() != util.ProtocolVersion {
+		t.Errorf("welcomed with version %d, want %d",
+			welcome.GetProtocolVersion(), util.ProtocolVersion)
+	}
+	if want := []string{util.FeatureStream}; !reflect.DeepEqual(welcome.GetFeatures(), want) {
+		t.Errorf("welcomed with features %v, want %v", welcome.GetFeatures(), want)
+	}
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+)
+
+type selectorOp int
+
+const (
+	opEquals selectorOp = iota
+	opNotEquals
+	opExists
+	opNotExists
+)
+
+// labelRequirement is a single condition on an agent label.
+type labelRequirement struct {
+	key   string
+	value string
+	op    selectorOp
+}
+
+// labelSelector is a conjunction of label requirements, e.g.
+// "env=sim,tier!=canary,gpu,!spot". The empty selector matches every agent.
+type labelSelector []labelRequirement
+
+func parseLabelSelector(selector string) (sel labelSelector, err error) {
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req labelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			parts := strings.SplitN(term, "!=", 2)
+			req = labelRequirement{key: parts[0], value: parts[1], op: opNotEquals}
+		case strings.Contains(term, "=="):
+			parts := strings.SplitN(term, "==", 2)
+			req = labelRequirement{key: parts[0], value: parts[1], op: opEquals}
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(term, "=", 2)
+			req = labelRequirement{key: parts[0], value: parts[1], op: opEquals}
+		case strings.HasPrefix(term, "!"):
+			req = labelRequirement{key: term[1:], op: opNotExists}
+		default:
+			req = labelRequirement{key: term, op: opExists}
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if req.key == "" || strings.ContainsAny(req.key, "!=") ||
+			strings.ContainsAny(req.value, "!=") {
+			return nil, fmt.Errorf("invalid label selector term %q", term)
+		}
+		sel = append(sel, req)
+	}
+	return
+}
+
+// matches reports whether the labels satisfy every requirement. A label that
+// isn't set satisfies a != requirement.
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, found := labels[req.key]
+		switch req.op {
+		case opEquals:
+			if !found || value != req.value {
+				return false
+			}
+		case opNotEquals:
+			if found && value == req.value {
+				return false
+			}
+		case opExists:
+			if !found {
+				return false
+			}
+		case opNotExists:
+			if found {
+				return false
+			}
+		}
+	}
+	return true
+}
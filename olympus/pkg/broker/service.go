@@ -2,21 +2,312 @@ package broker
 
 import (
 	"context"
-	"math/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
 )
 
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
 type olympusFrontendServer struct {
 	pb.UnimplementedOlympusFrontendServiceServer
 	broker *Broker // The currently running broker
 }
 
+// agentInfo describes the agent for the frontend. Must be called with
+// broker.mu held.
+func agentInfo(a *agent) *pb.Agent {
+	return &pb.Agent{
+		Name:              a.name,
+		Identity:          a.String(),
+		Services:          append([]string(nil), a.services...),
+		ConnectTime:       timestamppb.New(a.connectedAt),
+		LastHeartbeatTime: timestamppb.New(a.lastHeartbeat),
+		ProtocolVersion:   a.protocolVersion,
+		Labels:            a.labels,
+		MaxConcurrency:    uint32(a.maxConcurrency),
+		InFlight:          uint32(len(a.inFlight)),
+		State:             a.state,
+		Features:          a.featureList(),
+	}
+}
+
+// hasLabels reports whether the agent carries all of the given labels.
+func hasLabels(a *agent, labels map[string]string) bool {
+	for key, value := range labels {
+		if v, found := a.labels[key]; !found || v != value {
+			return false
+		}
+	}
+	return true
+}
+
 // GetNumberOfAgents returns the number of agents that are currently connected
 // to Olympus.
 func (s *olympusFrontendServer) GetNumberOfAgents(
 	ctx context.Context, req *pb.GetNumberOfAgentsReq) (*pb.GetNumberOfAgentsRep, error) {
-	// TODO(bellabah): Should make use of information within the broker.
-	numAgents := rand.Intn(10)
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	numAgents := len(s.broker.agents)
 	return &pb.GetNumberOfAgentsRep{Number: int32(numAgents)}, nil
 }
+
+// ListAgents returns a page of the agents that are currently connected to
+// Olympus. Pages are ordered by identity, so the page token is the identity of
+// the last agent returned.
+func (s *olympusFrontendServer) ListAgents(
+	ctx context.Context, req *pb.ListAgentsReq) (*pb.ListAgentsRep, error) {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	rep, err := s.broker.listAgents(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return rep, nil
+}
+
+// listAgents returns the page of agents requested. Must be called with
+// broker.mu held.
+func (broker *Broker) listAgents(req *pb.ListAgentsReq) (*pb.ListAgentsRep, error) {
+	pageSize := int(req.GetPageSize())
+	switch {
+	case pageSize < 0:
+		return nil, fmt.Errorf("negative page size %d", pageSize)
+	case pageSize == 0:
+		pageSize = defaultPageSize
+	case pageSize > maxPageSize:
+		pageSize = maxPageSize
+	}
+
+	agents := make([]*agent, 0, len(broker.agents))
+	for _, a := range broker.agents {
+		if a.String() > req.GetPageToken() && hasLabels(a, req.GetLabels()) {
+			agents = append(agents, a)
+		}
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].String() < agents[j].String()
+	})
+
+	rep := &pb.ListAgentsRep{}
+	for _, a := range agents {
+		if len(rep.Agents) == pageSize {
+			rep.NextPageToken = rep.Agents[pageSize-1].Identity
+			break
+		}
+		rep.Agents = append(rep.Agents, agentInfo(a))
+	}
+	return rep, nil
+}
+
+// GetAgent returns the agent with the given identity.
+func (s *olympusFrontendServer) GetAgent(
+	ctx context.Context, req *pb.GetAgentReq) (*pb.GetAgentRep, error) {
+	identity, err := hex.DecodeString(req.GetIdentity())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument, "malformed identity %q: %v", req.GetIdentity(), err)
+	}
+
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	a, found := s.broker.agents[string(identity)]
+	if !found {
+		return nil, status.Errorf(
+			codes.NotFound, "no agent with identity %q", req.GetIdentity())
+	}
+	return &pb.GetAgentRep{Agent: agentInfo(a)}, nil
+}
+
+// WatchAgents streams the lifecycle events of the agents matching the request
+// until the client goes away.
+func (s *olympusFrontendServer) WatchAgents(
+	req *pb.WatchAgentsReq, stream pb.OlympusFrontendService_WatchAgentsServer) error {
+	s.broker.mu.Lock()
+	w := s.broker.addWatcher(req)
+	s.broker.mu.Unlock()
+	defer func() {
+		s.broker.mu.Lock()
+		s.broker.removeWatcher(w)
+		s.broker.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case event, ok := <-w.events:
+			if !ok {
+				s.broker.mu.Lock()
+				draining := s.broker.draining
+				s.broker.mu.Unlock()
+				if draining {
+					return status.Error(codes.Unavailable, drainReason)
+				}
+				return status.Error(
+					codes.ResourceExhausted, "watcher fell too far behind")
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ListDeadLetters returns the requests that ran out of retries.
+func (s *olympusFrontendServer) ListDeadLetters(
+	ctx context.Context, req *pb.ListDeadLettersReq) (*pb.ListDeadLettersRep, error) {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	rep := &pb.ListDeadLettersRep{}
+	for _, letter := range s.broker.deadLetters {
+		msg := letter.req.msg
+		if name := req.GetServiceName(); name != "" && name != msg.GetServiceName() {
+			continue
+		}
+		rep.DeadLetters = append(rep.DeadLetters, &pb.DeadLetter{
+			Id:            letter.req.id,
+			ServiceName:   msg.GetServiceName(),
+			Client:        hex.EncodeToString([]byte(letter.req.client)),
+			Attempts:      uint32(letter.req.attempts),
+			Reason:        letter.reason,
+			Time:          timestamppb.New(letter.time),
+			LabelSelector: msg.GetLabelSelector(),
+			PayloadType:   msg.GetPayload().GetTypeUrl(),
+		})
+	}
+	return rep, nil
+}
+
+// ReplayDeadLetter queues a dead-lettered request again.
+func (s *olympusFrontendServer) ReplayDeadLetter(
+	ctx context.Context, req *pb.ReplayDeadLetterReq) (*pb.ReplayDeadLetterRep, error) {
+	var rep *pb.ReplayDeadLetterRep
+	replay := func() {
+		if replayed := s.broker.replayDeadLetter(req.GetId()); replayed != nil {
+			rep = &pb.ReplayDeadLetterRep{
+				Id:            replayed.id,
+				CorrelationId: replayed.msg.GetCorrelationId(),
+			}
+		}
+	}
+	if !s.broker.do(replay) {
+		return nil, status.Error(codes.Unavailable, "broker is not running")
+	}
+	if rep == nil {
+		return nil, status.Errorf(codes.NotFound, "no dead letter %q", req.GetId())
+	}
+	return rep, nil
+}
+
+// withAgent runs fn on the broker loop with the agent of the hex encoded
+// identity.
+func (s *olympusFrontendServer) withAgent(hexIdentity string, fn func(a *agent)) error {
+	identity, err := hex.DecodeString(hexIdentity)
+	if err != nil {
+		return status.Errorf(
+			codes.InvalidArgument, "malformed identity %q: %v", hexIdentity, err)
+	}
+	found, leader := false, false
+	ran := s.broker.do(func() {
+		if leader = s.broker.isLeader(); !leader {
+			return
+		}
+		var a *agent
+		if a, found = s.broker.agents[string(identity)]; found {
+			fn(a)
+		}
+	})
+	switch {
+	case !ran:
+		return status.Error(codes.Unavailable, "broker is not running")
+	case !leader:
+		return status.Error(codes.FailedPrecondition, notLeaderReason)
+	case !found:
+		return status.Errorf(codes.NotFound, "no agent with identity %q", hexIdentity)
+	}
+	return nil
+}
+
+// DisconnectAgent disconnects an agent on behalf of an operator.
+func (s *olympusFrontendServer) DisconnectAgent(
+	ctx context.Context, req *pb.DisconnectAgentReq) (*pb.DisconnectAgentRep, error) {
+	if req.GetReason() == "" {
+		return nil, status.Error(codes.InvalidArgument, "a reason is required")
+	}
+	err := s.withAgent(req.GetIdentity(), func(a *agent) {
+		s.broker.audit("disconnect", a, req.GetOperator(), req.GetReason())
+		s.broker.disconnectAgent(a, req.GetReason())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DisconnectAgentRep{}, nil
+}
+
+// QuarantineAgent stops or resumes routing requests to an agent on behalf of
+// an operator.
+func (s *olympusFrontendServer) QuarantineAgent(
+	ctx context.Context, req *pb.QuarantineAgentReq) (*pb.QuarantineAgentRep, error) {
+	if req.GetReason() == "" {
+		return nil, status.Error(codes.InvalidArgument, "a reason is required")
+	}
+	rep := &pb.QuarantineAgentRep{}
+	err := s.withAgent(req.GetIdentity(), func(a *agent) {
+		action := "quarantine"
+		if req.GetRelease() {
+			action = "release"
+		}
+		s.broker.audit(action, a, req.GetOperator(), req.GetReason())
+		s.broker.quarantineAgent(a, req.GetRelease())
+		rep.Agent = agentInfo(a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// DrainAgent has an agent finish its in-flight requests and disconnect, on
+// behalf of an operator.
+func (s *olympusFrontendServer) DrainAgent(
+	ctx context.Context, req *pb.DrainAgentReq) (*pb.DrainAgentRep, error) {
+	if req.GetReason() == "" {
+		return nil, status.Error(codes.InvalidArgument, "a reason is required")
+	}
+	timeout := s.broker.drainTimeout
+	if req.GetTimeout() != nil {
+		timeout = req.GetTimeout().AsDuration()
+	}
+	if timeout <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid timeout %v", timeout)
+	}
+	rep := &pb.DrainAgentRep{}
+	err := s.withAgent(req.GetIdentity(), func(a *agent) {
+		s.broker.audit("drain", a, req.GetOperator(), req.GetReason())
+		s.broker.drainAgent(a, time.Now().Add(timeout), req.GetReason())
+		rep.Agent = agentInfo(a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// GetStats returns the request counters of the broker.
+func (s *olympusFrontendServer) GetStats(
+	ctx context.Context, req *pb.GetStatsReq) (*pb.GetStatsRep, error) {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	return s.broker.stats(), nil
+}
@@ -0,0 +1,138 @@
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+// stream tracks a reply the agent streams in chunks. The broker relays every
+// chunk to the client as it comes in, and every credit back to the agent, so
+// it never holds more than a chunk of the reply.
+type stream struct {
+	next  uint64 // Sequence number of the next chunk expected from the agent
+	acked uint64 // Sequence number of the next chunk expected by the client
+	last  uint64 // Sequence number of the last chunk, once relayed
+	ended bool   // Set once the last chunk is relayed
+	// Handed to the client with the chunks. Resuming the stream from another
+	// connection takes it, as the request id is easily guessed.
+	token string
+}
+
+func newStream() (*stream, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return &stream{token: hex.EncodeToString(token)}, nil
+}
+
+// The stream methods below must be called with broker.mu held.
+
+// handleChunk relays a chunk of a streamed reply from the agent to the
+// client. Chunks out of sequence, sent before the client rewound the stream,
+// are dropped.
+func (broker *Broker) handleChunk(identity string, chunk *discpb.Chunk) {
+	a, found := broker.agents[identity]
+	if !found {
+		broker.log.Warnf("dropping chunk from unknown agent %x", identity)
+		return
+	}
+	req, found := a.inFlight[chunk.GetId()]
+	if !found || req.stream == nil {
+		broker.log.Warnf("dropping unexpected chunk %q from %s", chunk.GetId(), a)
+		return
+	}
+	s := req.stream
+	if chunk.GetSequence() != s.next {
+		broker.log.Debugf("Dropping chunk %d of request %s, expecting %d",
+			chunk.GetSequence(), req.id, s.next)
+		return
+	}
+	s.next++
+	if chunk.GetLast() {
+		s.last, s.ended = chunk.GetSequence(), true
+	}
+	req.deadline = time.Now().Add(broker.replyTimeout(req))
+	msg := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_CHUNK,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Chunk{Chunk: &discpb.Chunk{
+			Id:            req.clientID,
+			Sequence:      chunk.GetSequence(),
+			Data:          chunk.GetData(),
+			Last:          chunk.GetLast(),
+			Size:          chunk.GetSize(),
+			CorrelationId: req.msg.GetCorrelationId(),
+			ResumeToken:   s.token,
+		}},
+	}
+	if err := broker.send(req.client, msg); err != nil {
+		broker.log.Warnf("failed to relay chunk %d of request %s to %x: %v",
+			chunk.GetSequence(), req.id, req.client, err)
+	}
+}
+
+// handleCredit relays a credit from the client to the agent streaming the
+// reply. A credit from another identity than the client's resumes the stream
+// on the client's new connection, provided it carries the resume token. The
+// request completes once the client acknowledged the last chunk.
+func (broker *Broker) handleCredit(identity string, credit *discpb.Credit) {
+	a, req := broker.findStream(credit.GetId())
+	if req == nil {
+		broker.log.Debugf("Ignoring credit for unknown stream %q from %x", credit.GetId(), identity)
+		return
+	}
+	s := req.stream
+	resume := false
+	if identity != req.client {
+		if subtle.ConstantTimeCompare([]byte(credit.GetResumeToken()), []byte(s.token)) != 1 {
+			broker.log.Warnf("Ignoring credit for stream %s from %x without its resume token",
+				req.id, identity)
+			return
+		}
+		broker.log.Infof("Resuming stream %s from chunk %d for %x",
+			req.id, credit.GetNextSequence(), identity)
+		req.client = identity
+		// The client may have missed chunks, the agent sends them again.
+		resume = true
+		s.next, s.ended = credit.GetNextSequence(), false
+	}
+	s.acked = credit.GetNextSequence()
+	req.deadline = time.Now().Add(broker.replyTimeout(req))
+	msg := &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_CREDIT,
+		Origin: &discpb.Entity{Type: entityType},
+		Command: &discpb.DiscoveryMessage_Credit{Credit: &discpb.Credit{
+			Id:           req.id,
+			NextSequence: credit.GetNextSequence(),
+			Credit:       credit.GetCredit(),
+			Resume:       resume,
+		}},
+	}
+	if err := broker.send(a.identity, msg); err != nil {
+		broker.log.Warnf("failed to relay credit of request %s to %s: %v", req.id, a, err)
+	}
+	if s.ended && s.acked > s.last {
+		delete(a.inFlight, req.id)
+		broker.completeRequest(req)
+		broker.getService(req.msg.GetServiceName()).stats.replies++
+		broker.offerAgent(a)
+	}
+}
+
+// findStream returns the dispatched request streaming the reply the client
+// knows by id, and the agent streaming it.
+func (broker *Broker) findStream(id string) (*agent, *request) {
+	for _, a := range broker.agents {
+		for _, req := range a.inFlight {
+			if req.stream != nil && req.clientID == id {
+				return a, req
+			}
+		}
+	}
+	return nil, nil
+}
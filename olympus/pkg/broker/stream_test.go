@@ -0,0 +1,254 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"gopkg.in/yaml.v2"
+
+	apollo "github.com/project-auxo/auxo/apollo/pkg/agent"
+	util "github.com/project-auxo/auxo/olympus/pkg/util"
+	discpb "github.com/project-auxo/auxo/olympus/proto/discovery"
+)
+
+const streamTestPort = 25595
+
+// sendMsg sends the message to the broker in an envelope of this build.
+func sendMsg(t *testing.T, socket *zmq.Socket, msg *discpb.DiscoveryMessage) {
+	t.Helper()
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if _, err = socket.SendMessage(util.Envelope(util.ProtocolVersion, msgBytes)); err != nil {
+		t.Fatalf("send %s: %v", msg.GetHeader(), err)
+	}
+}
+
+func chunkMsg(id string, sequence uint64) *discpb.DiscoveryMessage {
+	return &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_CHUNK,
+		Origin: &discpb.Entity{Type: discpb.Entity_AGENT},
+		Command: &discpb.DiscoveryMessage_Chunk{Chunk: &discpb.Chunk{
+			Id:       id,
+			Sequence: sequence,
+			Data:     []byte("chunk"),
+			Size:     2 * util.ChunkSize,
+		}},
+	}
+}
+
+func creditMsg(id, token string, next uint64) *discpb.DiscoveryMessage {
+	return &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_CREDIT,
+		Origin: &discpb.Entity{Type: discpb.Entity_CLIENT},
+		Command: &discpb.DiscoveryMessage_Credit{Credit: &discpb.Credit{
+			Id:           id,
+			NextSequence: next,
+			Credit:       util.ChunkCredit,
+			ResumeToken:  token,
+		}},
+	}
+}
+
+func TestResumingStreamTakesToken(t *testing.T) {
+	broker := startBroker(t, streamTestPort)
+	defer stopBroker(broker)
+	agent := connectAgent(t, streamTestPort)
+	defer agent.Close()
+	sendReady(t, agent, util.ProtocolVersion, util.FeatureStream)
+	if msg, _ := recvWithin(t, agent, time.Second); msg.GetHeader() != discpb.Header_HEADER_WELCOME {
+		t.Fatalf("agent got %v, want WELCOME", msg)
+	}
+
+	client := connectAgent(t, streamTestPort)
+	defer client.Close()
+	sendMsg(t, client, &discpb.DiscoveryMessage{
+		Header: discpb.Header_HEADER_REQUEST,
+		Origin: &discpb.Entity{Type: discpb.Entity_CLIENT},
+		Command: &discpb.DiscoveryMessage_Request{Request: &discpb.Request{
+			ServiceName:   "echo",
+			Stream:        true,
+			CorrelationId: "1",
+		}},
+	})
+	msg, _ := recvWithin(t, agent, time.Second)
+	if msg.GetHeader() != discpb.Header_HEADER_REQUEST {
+		t.Fatalf("agent got %v, want the REQUEST", msg)
+	}
+	id := msg.GetRequest().GetId()
+	sendMsg(t, agent, chunkMsg(id, 0))
+	msg, _ = recvWithin(t, client, time.Second)
+	chunk := msg.GetChunk()
+	if chunk == nil || chunk.GetResumeToken() == "" {
+		t.Fatalf("client got %v, want the first chunk with a resume token", msg)
+	}
+
+	// Another connection can't take the stream over without the token.
+	intruder := connectAgent(t, streamTestPort)
+	defer intruder.Close()
+	sendMsg(t, intruder, creditMsg(chunk.GetId(), "", 0))
+	sendMsg(t, intruder, creditMsg(chunk.GetId(), "0123456789abcdef", 0))
+	if msg, _ := recvWithin(t, agent, 2*heartbeatInterval); msg != nil {
+		t.Fatalf("agent got %v from a credit without the resume token", msg)
+	}
+	sendMsg(t, agent, chunkMsg(id, 1))
+	if msg, _ := recvWithin(t, client, time.Second); msg.GetChunk().GetSequence() != 1 {
+		t.Fatalf("client got %v, want chunk 1", msg)
+	}
+
+	// The client resumes from a new connection with it.
+	resumed := connectAgent(t, streamTestPort)
+	defer resumed.Close()
+	sendMsg(t, resumed, creditMsg(chunk.GetId(), chunk.GetResumeToken(), 1))
+	msg, _ = recvWithin(t, agent, time.Second)
+	if credit := msg.GetCredit(); credit.GetId() != id || credit.GetNextSequence() != 1 ||
+		!credit.GetResume() {
+		t.Fatalf("agent got %v, want a credit resuming from chunk 1", msg)
+	}
+	sendMsg(t, agent, chunkMsg(id, 1))
+	if msg, _ := recvWithin(t, resumed, time.Second); msg.GetChunk().GetSequence() != 1 {
+		t.Fatalf("resumed client got %v, want chunk 1", msg)
+	}
+}
+
+// blob is a large reply made up on the fly, the same on every read.
+type blob struct{ size int64 }
+
+func (b blob) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	if left := b.size - off; int64(len(p)) > left {
+		p, err = p[:left], io.EOF
+	}
+	for i := range p {
+		x := uint64(off + int64(i))
+		p[i] = byte(x ^ x>>8 ^ x>>19)
+	}
+	return len(p), err
+}
+
+// stallingBlob is a blob served by Apollo, which stalls once halfway through
+// for longer than the client waits.
+type stallingBlob struct {
+	blob
+	stall   time.Duration
+	stalled bool
+	closed  bool
+}
+
+func (b *stallingBlob) ReadAt(p []byte, off int64) (int, error) {
+	if !b.stalled && off >= b.size/2 {
+		b.stalled = true
+		time.Sleep(b.stall)
+	}
+	return b.blob.ReadAt(p, off)
+}
+
+func (b *stallingBlob) Close() error {
+	b.closed = true
+	return nil
+}
+
+// runApollo runs an agent of Apollo connected to the broker on the port,
+// streaming the source in reply to requests for echo, until the broker drains
+// it. The configuration of Apollo is internal to it, so it is read from YAML
+// into the type its constructor takes, like Apollo reads its config file.
+func runApollo(t *testing.T, port int, src io.ReaderAt, size int64) <-chan error {
+	t.Helper()
+	newAgent := reflect.ValueOf(apollo.New)
+	cfg := reflect.New(newAgent.Type().In(0).Elem())
+	yml := fmt.Sprintf("agent:\n  name: echo-agent\n  olympus: localhost\n  port: %d\n"+
+		"  max_concurrency: 4\n", port)
+	if err := yaml.Unmarshal([]byte(yml), cfg.Interface()); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	agent := newAgent.Call([]reflect.Value{cfg})[0].Interface().(*apollo.Agent)
+	agent.HandleStream("echo", func(*anypb.Any) (io.ReaderAt, int64, error) {
+		return src, size, nil
+	})
+	stopped := make(chan error, 1)
+	go func() { stopped <- agent.Run() }()
+	return stopped
+}
+
+// hashingWriter counts and hashes what it is written.
+type hashingWriter struct {
+	written int64
+	hash    hash.Hash
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	return w.hash.Write(p)
+}
+
+func TestStreamResumesAfterClientDrops(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 200MB")
+	}
+	broker := startBroker(t, streamTestPort+1)
+	defer stopBroker(broker)
+	const clientTimeout = 500 * time.Millisecond
+	src := &stallingBlob{blob: blob{size: 200<<20 + 12345}, stall: 3 * clientTimeout}
+	stopped := runApollo(t, streamTestPort+1, src, src.size)
+	onlyAgent(t, broker)
+
+	client, err := apollo.NewClient(fmt.Sprintf("tcp://localhost:%d", streamTestPort+1))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer client.Close()
+	// The client gives up on the connection while the agent stalls, and
+	// resumes the stream from a new one.
+	client.SetTimeout(clientTimeout)
+	w := &hashingWriter{hash: sha256.New()}
+	if err = client.Fetch(&discpb.Request{ServiceName: "echo"}, w); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	// The request completes once the broker gets the last credit, and the agent
+	// drains.
+	deadline := time.Now().Add(time.Second)
+	for n := 1; n != 0; time.Sleep(10 * time.Millisecond) {
+		broker.do(func() { n = broker.inFlight() })
+		if n != 0 && time.Now().After(deadline) {
+			t.Fatalf("%d request(s) still in flight", n)
+		}
+	}
+	broker.do(func() { broker.drain(time.Now().Add(time.Second)) })
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("agent: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the agent never drained")
+	}
+
+	if !src.stalled {
+		t.Error("the agent never stalled")
+	}
+	if !src.closed {
+		t.Error("the agent never closed the blob")
+	}
+	if w.written != src.size {
+		t.Errorf("fetched %d bytes, want %d", w.written, src.size)
+	}
+	want := sha256.New()
+	if _, err = io.Copy(want, io.NewSectionReader(src.blob, 0, src.size)); err != nil {
+		t.Fatalf("hash the blob: %v", err)
+	}
+	if !bytes.Equal(w.hash.Sum(nil), want.Sum(nil)) {
+		t.Error("fetched bytes differ from the blob")
+	}
+}
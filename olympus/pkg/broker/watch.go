@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/project-auxo/auxo/olympus/proto/olympus"
+)
+
+// Events buffered per watcher before it is considered too slow and dropped.
+const watchBufferSize = 64
+
+// watcher is a frontend subscription to agent lifecycle events.
+type watcher struct {
+	filter *pb.WatchAgentsReq
+	events chan *pb.AgentEvent // Closed when the watcher falls behind
+}
+
+func (w *watcher) matches(a *agent, services []string) bool {
+	if name := w.filter.GetName(); name != "" && name != a.name {
+		return false
+	}
+	service := w.filter.GetService()
+	if service == "" {
+		return true
+	}
+	for _, s := range services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// The watch methods below must be called with broker.mu held.
+
+func (broker *Broker) addWatcher(filter *pb.WatchAgentsReq) *watcher {
+	w := &watcher{filter: filter, events: make(chan *pb.AgentEvent, watchBufferSize)}
+	broker.watchers[w] = struct{}{}
+	return w
+}
+
+func (broker *Broker) removeWatcher(w *watcher) {
+	if _, found := broker.watchers[w]; found {
+		delete(broker.watchers, w)
+		close(w.events)
+	}
+}
+
+// publish notifies the interested watchers of an event about the agent.
+// Besides the services the agent offers now, a watcher filtering by service
+// also hears about changes involving the previously offered services.
+func (broker *Broker) publish(
+	eventType pb.AgentEvent_Type, a *agent, previousServices ...string) {
+	if len(broker.watchers) == 0 {
+		return
+	}
+	event := &pb.AgentEvent{
+		Type:  eventType,
+		Agent: agentInfo(a),
+		Time:  timestamppb.New(time.Now()),
+	}
+	services := append(append([]string(nil), previousServices...), a.services...)
+	for w := range broker.watchers {
+		if !w.matches(a, services) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			broker.log.Warnf("dropping watcher that fell %d events behind", watchBufferSize)
+			broker.removeWatcher(w)
+		}
+	}
+}
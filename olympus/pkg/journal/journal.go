@@ -0,0 +1,323 @@
+// Package journal implements the append-only log in which the broker keeps
+// the requests it accepted for at-least-once delivery, so that they survive a
+// restart.
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	opAppend byte = iota + 1
+	opDone
+	opHighest // Carries the highest ID appended, across compactions
+
+	// Rewrite the journal once it holds this many completed records.
+	compactThreshold = 1024
+	maxRecordSize    = 1 << 30
+)
+
+var errCorrupt = errors.New("corrupt journal record")
+
+// Entry is a request that has not been marked done yet.
+type Entry struct {
+	ID   string
+	Data []byte
+}
+
+// Journal is safe for concurrent use.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	pending map[string]*pending
+	seq     uint64 // Sequence number of the next new entry
+	highest string // Highest ID ever appended, see Highest
+	done    int    // Completed records since the last compaction
+}
+
+// pending is the data of an entry along with its place in append order.
+type pending struct {
+	data []byte
+	seq  uint64
+}
+
+// Open opens the journal at path, creating it if needed, and loads the entries
+// that are still pending. A torn record at the end of the file, left by a
+// crash in the middle of a write, is discarded. A corrupt record followed by
+// others is an error, as discarding the rest would lose requests.
+func Open(path string) (j *Journal, err error) {
+	j = &Journal{path: path, pending: make(map[string]*pending)}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := j.load(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	j.file = file
+	return j, nil
+}
+
+// load replays the records of the file, returning the offset past the last
+// valid one.
+func (j *Journal) load(file *os.File) (valid int64, err error) {
+	r := bufio.NewReader(file)
+	for {
+		op, id, data, n, err := readRecord(r)
+		if err == errCorrupt {
+			if torn, tornErr := isTorn(r); tornErr != nil || !torn {
+				return valid, fmt.Errorf("journal %s: %v at offset %d", j.path, err, valid)
+			}
+			return valid, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+		valid += n
+		j.apply(op, id, data)
+	}
+}
+
+// isTorn reports whether the rest of the file past a corrupt record is what a
+// crash in the middle of writing it leaves, nothing or zeroes.
+func isTorn(r io.Reader) (bool, error) {
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	for _, b := range rest {
+		if b != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// apply updates the entries with a record. Appending an entry that is already
+// pending replaces its data, but keeps its place.
+func (j *Journal) apply(op byte, id string, data []byte) {
+	switch op {
+	case opAppend:
+		if entry, found := j.pending[id]; found {
+			entry.data = data
+		} else {
+			j.pending[id] = &pending{data: data, seq: j.seq}
+			j.seq++
+		}
+		j.raiseHighest(id)
+	case opDone:
+		if _, found := j.pending[id]; found {
+			delete(j.pending, id)
+			j.done++
+		}
+	case opHighest:
+		j.raiseHighest(id)
+	}
+}
+
+// raiseHighest records the ID if it is the highest yet. IDs are compared as
+// unsigned decimal numbers, shorter ones first, so any other IDs compare in
+// some arbitrary but consistent order.
+func (j *Journal) raiseHighest(id string) {
+	if len(id) > len(j.highest) || (len(id) == len(j.highest) && id > j.highest) {
+		j.highest = id
+	}
+}
+
+// Append durably records the entry before returning.
+func (j *Journal) Append(id string, data []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.write(opAppend, id, data); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.apply(opAppend, id, data)
+	return nil
+}
+
+// Done marks the entry as completed. Unknown IDs are ignored.
+func (j *Journal) Done(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, found := j.pending[id]; !found {
+		return nil
+	}
+	if err := j.write(opDone, id, nil); err != nil {
+		return err
+	}
+	j.apply(opDone, id, nil)
+	if j.done >= compactThreshold {
+		return j.compact()
+	}
+	return nil
+}
+
+// Pending returns the entries that are not done, in the order they were
+// first appended.
+func (j *Journal) Pending() []Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.entries()
+}
+
+// entries returns the pending entries in append order. Must be called with
+// j.mu held.
+func (j *Journal) entries() (entries []Entry) {
+	for id, entry := range j.pending {
+		entries = append(entries, Entry{ID: id, Data: entry.data})
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return j.pending[entries[a].ID].seq < j.pending[entries[b].ID].seq
+	})
+	return
+}
+
+// Highest returns the highest ID ever appended to the journal, including
+// those since done and compacted away, or "" if there never was any. Decimal
+// IDs compare as numbers, so that a caller numbering its entries can carry on
+// from there after a restart without reusing any ID.
+func (j *Journal) Highest() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.highest
+}
+
+func (j *Journal) Close() (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		err = j.file.Close()
+		j.file = nil
+	}
+	return
+}
+
+// compact rewrites the journal with only the pending entries and the highest
+// ID, atomically replacing the old file. Must be called with j.mu held.
+func (j *Journal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	if _, err = w.Write(encodeRecord(opHighest, j.highest, nil)); err != nil {
+		tmp.Close()
+		return err
+	}
+	for _, entry := range j.entries() {
+		if _, err = w.Write(encodeRecord(opAppend, entry.ID, entry.Data)); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = os.Rename(tmpPath, j.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	// The rename is only durable once the directory is synced.
+	if err = syncDir(filepath.Dir(j.path)); err != nil {
+		tmp.Close()
+		return err
+	}
+	j.file.Close()
+	j.file = tmp
+	j.done = 0
+	return nil
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (j *Journal) write(op byte, id string, data []byte) error {
+	if j.file == nil {
+		return fmt.Errorf("journal %s is closed", j.path)
+	}
+	_, err := j.file.Write(encodeRecord(op, id, data))
+	return err
+}
+
+// A record is laid out as op, id length, data length, id, data and the CRC-32
+// of everything before it, lengths and checksum being big-endian uint32s.
+func encodeRecord(op byte, id string, data []byte) []byte {
+	buf := make([]byte, 0, 1+4+4+len(id)+len(data)+4)
+	buf = append(buf, op)
+	buf = appendUint32(buf, uint32(len(id)))
+	buf = appendUint32(buf, uint32(len(data)))
+	buf = append(buf, id...)
+	buf = append(buf, data...)
+	return appendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+func readRecord(r io.Reader) (op byte, id string, data []byte, n int64, err error) {
+	header := make([]byte, 9)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	op = header[0]
+	idLen := binary.BigEndian.Uint32(header[1:5])
+	dataLen := binary.BigEndian.Uint32(header[5:9])
+	if (op != opAppend && op != opDone && op != opHighest) || uint64(idLen)+uint64(dataLen) > maxRecordSize {
+		err = errCorrupt
+		return
+	}
+	body := make([]byte, int(idLen)+int(dataLen)+4)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	sum := binary.BigEndian.Uint32(body[len(body)-4:])
+	if crc32.ChecksumIEEE(append(header, body[:len(body)-4]...)) != sum {
+		err = errCorrupt
+		return
+	}
+	id = string(body[:idLen])
+	data = body[idLen : len(body)-4]
+	n = int64(len(header) + len(body))
+	return
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
@@ -0,0 +1,118 @@
+package journal
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func openTemp(t *testing.T) (*Journal, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return j, path
+}
+
+func TestAppendIsIdempotent(t *testing.T) {
+	j, path := openTemp(t)
+	for _, id := range []string{"1", "2", "1"} {
+		if err := j.Append(id, []byte("data "+id)); err != nil {
+			t.Fatalf("Append(%s): %v", id, err)
+		}
+	}
+	// Done and appended again, like a replayed dead letter.
+	if err := j.Done("2"); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if err := j.Append("2", []byte("again")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	j.Close()
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer j.Close()
+	entries := j.Pending()
+	if len(entries) != 2 || entries[0].ID != "1" || entries[1].ID != "2" {
+		t.Fatalf("Pending() = %v, want entries 1 and 2 once each", entries)
+	}
+	if string(entries[1].Data) != "again" {
+		t.Errorf("entry 2 has data %q, want %q", entries[1].Data, "again")
+	}
+}
+
+func TestHighestSurvivesCompaction(t *testing.T) {
+	j, path := openTemp(t)
+	for n := 1; n <= compactThreshold+1; n++ {
+		id := strconv.Itoa(n)
+		if err := j.Append(id, nil); err != nil {
+			t.Fatalf("Append(%s): %v", id, err)
+		}
+		if n != 9 {
+			if err := j.Done(id); err != nil {
+				t.Fatalf("Done(%s): %v", id, err)
+			}
+		}
+	}
+	j.Close()
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer j.Close()
+	if entries := j.Pending(); len(entries) != 1 || entries[0].ID != "9" {
+		t.Errorf("Pending() = %v, want only entry 9", entries)
+	}
+	if got, want := j.Highest(), strconv.Itoa(compactThreshold+1); got != want {
+		t.Errorf("Highest() = %q, want %q", got, want)
+	}
+}
+
+func TestCorruptRecords(t *testing.T) {
+	j, path := openTemp(t)
+	for _, id := range []string{"1", "2", "3"} {
+		if err := j.Append(id, []byte("data "+id)); err != nil {
+			t.Fatalf("Append(%s): %v", id, err)
+		}
+	}
+	j.Close()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	recordSize := len(encodeRecord(opAppend, "1", []byte("data 1")))
+
+	// A crash tore the last record.
+	torn := append([]byte(nil), buf[:len(buf)-2]...)
+	if err = ioutil.WriteFile(path, torn, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if j, err = Open(path); err != nil {
+		t.Fatalf("Open with a torn record: %v", err)
+	}
+	if entries := j.Pending(); len(entries) != 2 {
+		t.Errorf("Pending() = %v, want entries 1 and 2", entries)
+	}
+	j.Close()
+
+	// The second record went bad on disk, which loses the third unless noticed.
+	corrupt := append([]byte(nil), buf...)
+	corrupt[2*recordSize-2]++
+	if err = ioutil.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if j, err = Open(path); err == nil {
+		j.Close()
+		t.Fatal("Open succeeded with a corrupt record in the middle")
+	}
+	if after, _ := ioutil.ReadFile(path); len(after) != len(corrupt) {
+		t.Errorf("Open cut the journal down to %d bytes from %d", len(after), len(corrupt))
+	}
+}
@@ -0,0 +1,163 @@
+// Package payload maps the services routed by Olympus to the message types
+// they exchange in the Any payloads of their requests and replies, and packs
+// and unpacks those payloads.
+package payload
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ErrNoPayload is returned when a payload is required but missing.
+var ErrNoPayload = errors.New("no payload")
+
+// Default is the registry of the services linked into the binary, which they
+// usually register with in an init function.
+var Default = NewRegistry()
+
+// Registry is safe for concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	requests map[string]map[protoreflect.FullName]bool // Keyed by service name
+	replies  map[string]map[protoreflect.FullName]bool // Keyed by service name
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		requests: make(map[string]map[protoreflect.FullName]bool),
+		replies:  make(map[string]map[protoreflect.FullName]bool),
+	}
+}
+
+// Register adds the request and reply types of the service to the default
+// registry.
+func Register(service string, request, reply proto.Message) {
+	Default.Register(service, request, reply)
+}
+
+// Register adds a request and a reply type of the service, either of which may
+// be nil. A service may register several of each.
+func (r *Registry) Register(service string, request, reply proto.Message) {
+	var requests, replies []string
+	if request != nil {
+		requests = append(requests, string(request.ProtoReflect().Descriptor().FullName()))
+	}
+	if reply != nil {
+		replies = append(replies, string(reply.ProtoReflect().Descriptor().FullName()))
+	}
+	r.RegisterNames(service, requests, replies)
+}
+
+// RegisterNames adds request and reply types of the service by their full
+// protobuf names, such as "seek.StepReq". Unlike Register, the types need not
+// be linked into the binary, which suits the broker.
+func (r *Registry) RegisterNames(service string, requests, replies []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	add(r.requests, service, requests)
+	add(r.replies, service, replies)
+}
+
+func add(types map[string]map[protoreflect.FullName]bool, service string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	if types[service] == nil {
+		types[service] = make(map[protoreflect.FullName]bool)
+	}
+	for _, name := range names {
+		types[service][protoreflect.FullName(name)] = true
+	}
+}
+
+// CheckRequest returns an error if the service registered request types and
+// the payload is of none of them. Any payload is accepted for the services
+// that registered none.
+func (r *Registry) CheckRequest(service string, payload *anypb.Any) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return check(r.requests[service], "request", service, payload)
+}
+
+// CheckReply is CheckRequest for replies.
+func (r *Registry) CheckReply(service string, payload *anypb.Any) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return check(r.replies[service], "reply", service, payload)
+}
+
+func check(
+	types map[protoreflect.FullName]bool, kind, service string, payload *anypb.Any) error {
+	if len(types) == 0 {
+		return nil
+	}
+	if payload == nil {
+		return fmt.Errorf("%s %s: %w", service, kind, ErrNoPayload)
+	}
+	if name := payload.MessageName(); !types[name] {
+		return fmt.Errorf("%s %s: unexpected payload type %q, expected one of %s",
+			service, kind, name, names(types))
+	}
+	return nil
+}
+
+func names(types map[protoreflect.FullName]bool) string {
+	var names []string
+	for name := range types {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Pack wraps the message in an Any payload.
+func Pack(msg proto.Message) (*anypb.Any, error) {
+	if msg == nil {
+		return nil, ErrNoPayload
+	}
+	payload, err := anypb.New(msg)
+	if err != nil {
+		return nil, fmt.Errorf("could not pack %s: %v",
+			msg.ProtoReflect().Descriptor().FullName(), err)
+	}
+	return payload, nil
+}
+
+// Unpack unmarshals the payload into msg, which must be of the payload's type.
+func Unpack(payload *anypb.Any, msg proto.Message) error {
+	if payload == nil {
+		return ErrNoPayload
+	}
+	want := msg.ProtoReflect().Descriptor().FullName()
+	if got := payload.MessageName(); got != want {
+		return fmt.Errorf("payload is a %s, not a %s", got, want)
+	}
+	if err := payload.UnmarshalTo(msg); err != nil {
+		return fmt.Errorf("could not unpack %s: %v", want, err)
+	}
+	return nil
+}
+
+// UnpackNew unmarshals the payload into a new message of its type, which must
+// be linked into the binary.
+func UnpackNew(payload *anypb.Any) (proto.Message, error) {
+	if payload == nil {
+		return nil, ErrNoPayload
+	}
+	msg, err := payload.UnmarshalNew()
+	if errors.Is(err, protoregistry.NotFound) {
+		return nil, fmt.Errorf("payload type %s is unknown to this binary", payload.MessageName())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not unpack %s: %v", payload.MessageName(), err)
+	}
+	return msg, nil
+}
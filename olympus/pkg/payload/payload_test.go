@@ -0,0 +1,48 @@
+package payload
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCheckRequest(t *testing.T) {
+	r := NewRegistry()
+	r.Register("echo", &wrapperspb.StringValue{}, &wrapperspb.StringValue{})
+	r.RegisterNames("count", []string{"google.protobuf.Int64Value"}, nil)
+	str, _ := anypb.New(wrapperspb.String("hello"))
+	num, _ := anypb.New(wrapperspb.Int64(1))
+
+	for _, tc := range []struct {
+		service string
+		payload *anypb.Any
+		ok      bool
+	}{
+		{"echo", str, true},
+		{"echo", num, false},
+		{"echo", nil, false},
+		{"count", num, true},
+		{"count", str, false},
+		// Services that registered no types take any payload.
+		{"unknown", str, true},
+		{"unknown", nil, true},
+	} {
+		err := r.CheckRequest(tc.service, tc.payload)
+		if (err == nil) != tc.ok {
+			t.Errorf("CheckRequest(%s, %s) = %v, want ok %v",
+				tc.service, tc.payload.MessageName(), err, tc.ok)
+		}
+	}
+	if err := r.CheckRequest("echo", nil); !errors.Is(err, ErrNoPayload) {
+		t.Errorf("CheckRequest without a payload = %v, want %v", err, ErrNoPayload)
+	}
+	// Replies are checked against their own types.
+	if err := r.CheckReply("count", num); err != nil {
+		t.Errorf("CheckReply of a service without reply types = %v", err)
+	}
+	if err := r.CheckReply("echo", num); err == nil {
+		t.Error("CheckReply accepted a payload of another type")
+	}
+}
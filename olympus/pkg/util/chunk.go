@@ -0,0 +1,18 @@
+package util
+
+const (
+	// ChunkSize is the size of the chunks a streamed reply is cut into.
+	ChunkSize = 1 << 20
+	// ChunkCredit is the number of chunks a stream is let ahead of its
+	// receiver, which the sender may send before hearing from it.
+	ChunkCredit = 8
+)
+
+// ChunkCount returns the number of chunks a reply of size bytes is streamed
+// in, at least one.
+func ChunkCount(size int64) uint64 {
+	if size <= 0 {
+		return 1
+	}
+	return uint64((size + ChunkSize - 1) / ChunkSize)
+}
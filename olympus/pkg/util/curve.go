@@ -0,0 +1,73 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Length of a Z85 encoded CURVE key.
+const curveKeyLength = 40
+
+// ReadCurveKey reads a Z85 encoded CURVE key, alone in its file.
+func ReadCurveKey(path string) (key string, err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	key = strings.TrimSpace(string(buf))
+	if len(key) != curveKeyLength {
+		return "", fmt.Errorf("%s: not a Z85 encoded CURVE key", path)
+	}
+	return
+}
+
+// ReadCurveKeys reads a list of Z85 encoded CURVE keys, one per line. Empty
+// lines and lines starting with # are skipped.
+func ReadCurveKeys(path string) (keys []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if len(key) != curveKeyLength {
+			return nil, fmt.Errorf("%s:%d: not a Z85 encoded CURVE key", path, line)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// CurveKeypair reads a secret key and derives its public key.
+func CurveKeypair(secretKeyPath string) (publicKey, secretKey string, err error) {
+	if secretKey, err = ReadCurveKey(secretKeyPath); err != nil {
+		return
+	}
+	publicKey, err = zmq.AuthCurvePublic(secretKey)
+	return
+}
+
+// WriteCurveKeypair generates a keypair, writing the public key to
+// <base>.key and the secret key, readable by the owner only, to
+// <base>.key_secret.
+func WriteCurveKeypair(base string) (publicKey string, err error) {
+	publicKey, secretKey, err := zmq.NewCurveKeypair()
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(base+".key_secret", []byte(secretKey+"\n"), 0600); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(base+".key", []byte(publicKey+"\n"), 0644)
+	return
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Discovery messages travel in an envelope of frames: an empty delimiter, the
+// protocol header and the body, a marshalled DiscoveryMessage. The header
+// names the protocol version the sender speaks. The ROUTER socket of the
+// broker prepends the identity frame of the sender on the way in, and strips
+// it on the way out. Peers speaking a version predating envelopes send and
+// expect the body alone, as do agents announcing themselves with READY,
+// before a version is negotiated.
+const envelopePrefix = "AUXO/"
+
+// Envelope returns the frames carrying the body to a peer speaking the
+// version, as sent by a DEALER socket.
+func Envelope(version uint32, body []byte) [][]byte {
+	if version < envelopeVersion {
+		return [][]byte{body}
+	}
+	return [][]byte{{}, []byte(envelopePrefix + strconv.FormatUint(uint64(version), 10)), body}
+}
+
+// OpenEnvelope returns the body carried by the frames received on a DEALER
+// socket, or following the identity frame on a ROUTER socket, along with the
+// version the sender speaks. The version is 0 when the sender sent the body
+// alone.
+func OpenEnvelope(frames [][]byte) (body []byte, version uint32, err error) {
+	switch {
+	case len(frames) == 1:
+		return frames[0], 0, nil
+	case len(frames) != 3 || len(frames[0]) != 0:
+		return nil, 0, fmt.Errorf("malformed envelope of %d frame(s)", len(frames))
+	}
+	header := string(frames[1])
+	parsed, err := strconv.ParseUint(strings.TrimPrefix(header, envelopePrefix), 10, 32)
+	if !strings.HasPrefix(header, envelopePrefix) || err != nil {
+		return nil, 0, fmt.Errorf("unknown protocol header %q", header)
+	}
+	return frames[2], uint32(parsed), nil
+}
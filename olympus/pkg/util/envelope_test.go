@@ -0,0 +1,37 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	body := []byte("body")
+	for _, tc := range []struct {
+		version, want uint32
+		frames        int
+	}{
+		{1, 0, 1},
+		{featureFlagsVersion, 0, 1},
+		{envelopeVersion, envelopeVersion, 3},
+		{ProtocolVersion, ProtocolVersion, 3},
+	} {
+		frames := Envelope(tc.version, body)
+		if len(frames) != tc.frames {
+			t.Errorf("Envelope(%d) has %d frame(s), want %d", tc.version, len(frames), tc.frames)
+		}
+		got, version, err := OpenEnvelope(frames)
+		if err != nil || !bytes.Equal(got, body) || version != tc.want {
+			t.Errorf("OpenEnvelope(Envelope(%d)) = %q, %d, %v, want %q, %d",
+				tc.version, got, version, err, body, tc.want)
+		}
+	}
+}
+
+func TestOpenEnvelopeRejectsUnknownHeader(t *testing.T) {
+	for _, header := range []string{"HTTP/1.1", "AUXO/", "AUXO/x"} {
+		if _, _, err := OpenEnvelope([][]byte{{}, []byte(header), nil}); err == nil {
+			t.Errorf("OpenEnvelope accepted the header %q", header)
+		}
+	}
+}
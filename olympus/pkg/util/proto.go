@@ -7,6 +7,81 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	// ProtocolVersion is the version of the discovery protocol spoken by this
+	// build of Olympus and Apollo.
+	ProtocolVersion = 3
+	// MinProtocolVersion is the oldest version this build still speaks,
+	// through compatibility shims.
+	MinProtocolVersion = 1
+	// featureFlagsVersion is the version that introduced feature flags and
+	// the WELCOME reply to READY.
+	featureFlagsVersion = 2
+	// envelopeVersion is the version that introduced envelopes, see Envelope.
+	envelopeVersion = 3
+)
+
+// Feature flags exchanged on READY. Both ends only rely on the features the
+// other end supports too.
+const (
+	// The agent works on up to max_concurrency requests at once.
+	FeatureConcurrency = "concurrency"
+	// The agent finishes its in-flight requests when asked to disconnect by
+	// a deadline.
+	FeatureDrain = "drain"
+	// The agent streams replies in chunks.
+	FeatureStream = "stream"
+)
+
+// Features are the features supported by this build.
+var Features = []string{FeatureConcurrency, FeatureDrain, FeatureStream}
+
+// _v1Features are the features implied by version 1, which predates feature
+// flags. Agents of version 1 leave as soon as they are told to disconnect,
+// without finishing their requests, so they don't drain.
+var _v1Features = []string{FeatureConcurrency}
+
+// NegotiateVersion returns the highest version spoken by both this build and
+// the other end, which speaks up to theirs. Agents predating version
+// negotiation leave their version unset, and speak version 1.
+func NegotiateVersion(theirs uint32) (version uint32, err error) {
+	if theirs == 0 {
+		theirs = 1
+	}
+	if theirs < MinProtocolVersion {
+		return 0, fmt.Errorf("protocol version %d is no longer supported, %d or later is required",
+			theirs, MinProtocolVersion)
+	}
+	if version = theirs; version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	return
+}
+
+// NegotiateFeatures returns the features supported by both this build and the
+// other end, which speaks the negotiated version and declared theirs.
+func NegotiateFeatures(version uint32, theirs []string) (features []string) {
+	if version < featureFlagsVersion {
+		theirs = _v1Features
+	}
+	supported := make(map[string]bool, len(theirs))
+	for _, feature := range theirs {
+		supported[feature] = true
+	}
+	for _, feature := range Features {
+		if supported[feature] {
+			features = append(features, feature)
+		}
+	}
+	return
+}
+
+// Welcomes reports whether the negotiated version has the broker answer READY
+// with WELCOME.
+func Welcomes(version uint32) bool {
+	return version >= featureFlagsVersion
+}
+
 func UnmarshalDiscoveryMessage(msg []byte) (msgProto *discpb.DiscoveryMessage, err error) {
 	msgProto = &discpb.DiscoveryMessage{}
 	if err = proto.Unmarshal(msg, msgProto); err != nil {
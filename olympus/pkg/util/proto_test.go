@@ -0,0 +1,50 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, tc := range []struct {
+		theirs, want uint32
+	}{
+		{0, 1}, // Predates version negotiation
+		{1, 1},
+		{ProtocolVersion, ProtocolVersion},
+		{ProtocolVersion + 1, ProtocolVersion},
+	} {
+		got, err := NegotiateVersion(tc.theirs)
+		if err != nil || got != tc.want {
+			t.Errorf("NegotiateVersion(%d) = %d, %v, want %d", tc.theirs, got, err, tc.want)
+		}
+	}
+}
+
+func TestNegotiateFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		version uint32
+		theirs  []string
+		want    []string
+	}{
+		// Version 1 implies its features, whatever is declared.
+		{1, nil, []string{FeatureConcurrency}},
+		{1, Features, []string{FeatureConcurrency}},
+		{2, nil, nil},
+		{2, []string{FeatureStream, "teleport", FeatureDrain},
+			[]string{FeatureDrain, FeatureStream}},
+	} {
+		if got := NegotiateFeatures(tc.version, tc.theirs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("NegotiateFeatures(%d, %v) = %v, want %v", tc.version, tc.theirs, got, tc.want)
+		}
+	}
+}
+
+func TestWelcomes(t *testing.T) {
+	if Welcomes(1) {
+		t.Error("Welcomes(1) = true, version 1 predates WELCOME")
+	}
+	if !Welcomes(ProtocolVersion) {
+		t.Errorf("Welcomes(%d) = false", ProtocolVersion)
+	}
+}
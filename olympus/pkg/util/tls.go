@@ -0,0 +1,176 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConfig configures TLS on one end of a gRPC link.
+type TLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Certificate and key presented to the other end. Required on servers,
+	// optional on clients, which then authenticate with them.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// CA certificates to verify the other end with. A server given CAs
+	// requires a client certificate signed by one of them. A client without
+	// CAs verifies the server against the system roots.
+	CAFile string `yaml:"ca_file"`
+	// Name the server certificate is verified against, the dialed hostname
+	// when empty. Only used by clients.
+	ServerName string `yaml:"server_name"`
+}
+
+// ServerOptions returns the options securing a gRPC server as configured.
+// Changes to the certificate files are picked up on the next handshake.
+func ServerOptions(cfg TLSConfig) ([]grpc.ServerOption, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls: cert_file and key_file are required")
+	}
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := reloader.get()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsCfg))}, nil
+}
+
+// DialOption returns the option securing a gRPC client as configured.
+func DialOption(cfg TLSConfig) (grpc.DialOption, error) {
+	if !cfg.Enabled {
+		return grpc.WithInsecure(), nil
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.ServerName}
+	if cfg.CAFile != "" {
+		pool, err := readCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile, "")
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := reloader.get()
+			return cert, nil
+		}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)), nil
+}
+
+func readCertPool(path string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("%s: no PEM encoded certificate", path)
+	}
+	return pool, nil
+}
+
+// certReloader holds a certificate, and optionally a CA pool, read from
+// files. They are read again once any of the files changes, while a broken
+// update leaves the previous ones in use.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu      sync.Mutex // Guards the fields below
+	modTime time.Time  // Latest modification time of the files loaded
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (r *certReloader, err error) {
+	r = &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.load(modTime); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (r *certReloader) latestModTime() (latest time.Time, err error) {
+	for _, path := range []string{r.certFile, r.keyFile, r.caFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return
+}
+
+// load reads the files. Must be called with r.mu held, or before r is shared.
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		if pool, err = readCertPool(r.caFile); err != nil {
+			return err
+		}
+	}
+	r.cert, r.pool, r.modTime = &cert, pool, modTime
+	return nil
+}
+
+// get returns the current certificate and CA pool, reloading them first if
+// the files changed.
+func (r *certReloader) get() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	modTime, err := r.latestModTime()
+	if err != nil {
+		log.Warnf("keeping the loaded certificate %s: %v", r.certFile, err)
+	} else if modTime.After(r.modTime) {
+		if err := r.load(modTime); err != nil {
+			log.Warnf("keeping the loaded certificate %s: %v", r.certFile, err)
+		} else {
+			log.Infof("Reloaded certificate %s", r.certFile)
+		}
+	}
+	return r.cert, r.pool
+}
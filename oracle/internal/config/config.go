@@ -1,9 +1,13 @@
 package config
 
+import "github.com/project-auxo/auxo/olympus/pkg/util"
+
 type Config struct {
 	Oracle struct {
 		Name     string `yaml:"name"`
 		Hostname string `yaml:"hostname"`
 		Port     int    `yaml:"port"`
+		// Serve over TLS, requiring client certificates when given a CA.
+		TLS util.TLSConfig `yaml:"tls"`
 	} `yaml:"oracle"`
 }
@@ -51,7 +51,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("set up %s: %v", name, err)
 	}
-	s := grpc.NewServer()
+	opts, err := util.ServerOptions(cfg.Oracle.TLS)
+	if err != nil {
+		log.Fatalf("set up %s: %v", name, err)
+	}
+	s := grpc.NewServer(opts...)
 	pb.RegisterOracleBackendServiceServer(s, &oracle.OracleBackendServer{})
 
 	log.Infof("⇨ %s started on %s", name, endpoint)
@@ -0,0 +1,14 @@
+package seek
+
+import (
+	"github.com/project-auxo/auxo/olympus/pkg/payload"
+	pb "github.com/project-auxo/auxo/oracle/services/auxo/seek/proto"
+)
+
+// ServiceName is the name Olympus routes the requests for the sim by.
+const ServiceName = "auxo/seek"
+
+func init() {
+	// The sim takes commands, and replies with the state they lead to.
+	payload.Register(ServiceName, &pb.Command{}, &pb.SimState{})
+}